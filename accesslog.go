@@ -0,0 +1,122 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mikespook/golib/log"
+)
+
+// accessLog writes access log lines to a file rotated by size and age,
+// or to stdout/stderr.
+type accessLog struct {
+	sync.Mutex
+	w       io.Writer
+	file    *os.File
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	size    int64
+	opened  time.Time
+}
+
+// SetAccessLog writes access log lines to path instead of the general
+// log. "stdout" and "stderr" write to the standard streams. A file is
+// rotated when it reaches maxSize bytes or gets older than maxAge; zero
+// disables either. An empty path goes back to the general log.
+func (h *Handler) SetAccessLog(path string, maxSize int64, maxAge time.Duration) error {
+	if h.access != nil {
+		h.access.close()
+		h.access = nil
+	}
+	a := &accessLog{path: path, maxSize: maxSize, maxAge: maxAge}
+	switch path {
+	case "":
+		return nil
+	case "stdout":
+		a.w = os.Stdout
+	case "stderr":
+		a.w = os.Stderr
+	default:
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	h.access = a
+	return nil
+}
+
+func (a *accessLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.w = f, f
+	a.size = fi.Size()
+	a.opened = time.Now()
+	return nil
+}
+
+// rotate moves the file aside and opens a new one. The old file is kept
+// until then, so lines still go somewhere if either step fails.
+func (a *accessLog) rotate() error {
+	old := a.file
+	if err := os.Rename(a.path, a.path+"."+time.Now().Format("20060102150405")); err != nil {
+		return err
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func (a *accessLog) write(line string) {
+	a.Lock()
+	defer a.Unlock()
+	if a.file != nil {
+		if (a.maxSize > 0 && a.size >= a.maxSize) ||
+			(a.maxAge > 0 && time.Since(a.opened) >= a.maxAge) {
+			if err := a.rotate(); err != nil {
+				// Try again at the next threshold, not on every line.
+				a.size, a.opened = 0, time.Now()
+				log.Errorf("Rotate access log: %s", err)
+			}
+		}
+	}
+	n, err := fmt.Fprintf(a.w, "%s %s\n", time.Now().Format(time.RFC3339), line)
+	a.size += int64(n)
+	if err != nil {
+		log.Errorf("Write access log: %s", err)
+	}
+}
+
+func (a *accessLog) close() {
+	a.Lock()
+	defer a.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+func (h *Handler) accessf(format string, v ...interface{}) {
+	if h.access == nil {
+		log.Messagef(format, v...)
+		return
+	}
+	h.access.write(fmt.Sprintf(format, v...))
+}
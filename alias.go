@@ -0,0 +1,47 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+	"path"
+)
+
+type alias struct {
+	name     string
+	redirect bool
+}
+
+// SetAlias makes requests to the script old run the script name, e.g.
+// after a rename while providers still call the old one. With redirect
+// the client is redirected to the new path instead.
+func (h *Handler) SetAlias(old, name string, redirect bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.aliases[old] = alias{name, redirect}
+}
+
+func (h *Handler) alias(name string) (alias, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	a, ok := h.aliases[name]
+	return a, ok
+}
+
+// redirectAlias redirects requests to redirecting aliases. It returns
+// whether r was redirected.
+func (h *Handler) redirectAlias(w http.ResponseWriter, r *http.Request) bool {
+	name, ok := h.rawScriptName(r.URL.Path)
+	if !ok {
+		return false
+	}
+	a, ok := h.alias(name)
+	if !ok || !a.redirect {
+		return false
+	}
+	h.redirect(w, r, path.Join(h.rootUrl, a.name))
+	return true
+}
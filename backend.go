@@ -0,0 +1,164 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikespook/golib/log"
+)
+
+// BackendPolicy decides what happens when a backend of a binding, like
+// the database, is down when it is set up.
+type BackendPolicy int
+
+const (
+	// BackendRequired makes setting up the backend fail.
+	BackendRequired BackendPolicy = iota
+	// BackendDegraded sets it up anyway. Calls fail until it is back.
+	BackendDegraded
+	// BackendRetry sets it up and reconnects in the background. Calls
+	// fail with ErrBackendDown until it is connected.
+	BackendRetry
+)
+
+const (
+	backendRetryMin = time.Second
+	backendRetryMax = time.Minute
+)
+
+// backend tracks whether a backend set up with BackendRetry is reachable
+// yet.
+type backend struct {
+	name   string
+	down   int32
+	cancel context.CancelFunc
+}
+
+// setup pings the backend and applies policy if it is down. Nothing
+// changes when it fails, so the backend set up before stays.
+func (b *backend) setup(policy BackendPolicy, ping func() error) error {
+	err := ping()
+	if err != nil && policy == BackendRequired {
+		return err
+	}
+	b.stop()
+	if err == nil {
+		return nil
+	}
+	switch policy {
+	case BackendDegraded:
+		log.Warningf("%s is down, starting without it: %s", b.name, err)
+	case BackendRetry:
+		log.Warningf("%s is down, retrying: %s", b.name, err)
+		atomic.StoreInt32(&b.down, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		b.cancel = cancel
+		go b.retry(ctx, ping)
+	}
+	return nil
+}
+
+// retry pings with backoff until the backend answers.
+func (b *backend) retry(ctx context.Context, ping func() error) {
+	for wait := backendRetryMin; ; wait *= 2 {
+		if wait > backendRetryMax {
+			wait = backendRetryMax
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if err := ping(); err != nil {
+			log.Debugf("%s is still down: %s", b.name, err)
+			continue
+		}
+		atomic.StoreInt32(&b.down, 0)
+		log.Messagef("%s is back", b.name)
+		return
+	}
+}
+
+// stop stops reconnecting.
+func (b *backend) stop() {
+	if b.cancel != nil {
+		b.cancel()
+		b.cancel = nil
+	}
+	atomic.StoreInt32(&b.down, 0)
+}
+
+// check fails with ErrBackendDown while reconnecting.
+func (b *backend) check() error {
+	if atomic.LoadInt32(&b.down) == 1 {
+		return ErrBackendDown
+	}
+	return nil
+}
+
+// SetLockerPolicy sets what SetLocker does when the lock store can not
+// be reached. The default is BackendRequired.
+func (h *Handler) SetLockerPolicy(policy BackendPolicy) {
+	h.lockerPolicy = policy
+}
+
+// SetHttpBackend checks the backend of ghoko.Http answering healthUrl,
+// before serving, and applies policy if it does not answer with a status
+// below 500. With BackendRetry, calls to its host fail with
+// ErrBackendDown until it does.
+func (h *Handler) SetHttpBackend(healthUrl string, policy BackendPolicy) error {
+	u, err := url.Parse(healthUrl)
+	if err != nil {
+		return err
+	}
+	if h.httpBackends == nil {
+		h.httpBackends = make(map[string]*backend)
+	}
+	b, ok := h.httpBackends[u.Host]
+	if !ok {
+		b = &backend{name: "HTTP backend " + u.Host}
+	}
+	if err := b.setup(policy, func() error { return h.healthCheck(healthUrl) }); err != nil {
+		return err
+	}
+	h.httpBackends[u.Host] = b
+	return nil
+}
+
+// healthCheck gets healthUrl, bypassing the outbound guards.
+func (h *Handler) healthCheck(healthUrl string) error {
+	resp, err := h.client.Get(healthUrl)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("health check %s: %s", healthUrl, resp.Status)
+	}
+	return nil
+}
+
+// httpBackend fails if the backend of host is reconnecting.
+func (h *Handler) httpBackend(host string) error {
+	if b, ok := h.httpBackends[host]; ok {
+		return b.check()
+	}
+	return nil
+}
+
+// closeBackends stops reconnecting to the lock store and HTTP backends.
+func (h *Handler) closeBackends() {
+	h.lockerBackend.stop()
+	for _, b := range h.httpBackends {
+		b.stop()
+	}
+}
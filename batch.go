@@ -0,0 +1,153 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync/atomic"
+)
+
+const defaultMaxBatchSize = 20
+
+type batchItem struct {
+	Name   string          `json:"name"`
+	Params json.RawMessage `json:"params"`
+	Sync   bool            `json:"sync"`
+}
+
+type batchResult struct {
+	Id     string `json:"id"`
+	Status int    `json:"status"`
+	Body   string `json:"body,omitempty"`
+}
+
+// SetBatch serves batches of hooks at p, which accepts a JSON array of
+// {"name", "params", "sync"} items. Sync items are run in order and
+// their status and body collected, async ones are enqueued. Batches of
+// more than max items get 413, zero keeps the default of 20. An empty
+// p disables it.
+func (h *Handler) SetBatch(p string, max int) {
+	if h.batchPath != "" {
+		delete(h.routes, h.batchPath)
+	}
+	if max == 0 {
+		max = defaultMaxBatchSize
+	}
+	h.batchPath, h.maxBatch = p, max
+	if p != "" {
+		h.routes[p] = h.serveBatch
+	}
+}
+
+func (h *Handler) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if h.InMaintenance() {
+		h.writeAndLogError(w, r, ErrMaintenance)
+		return
+	}
+	if h.maxBody > 0 {
+		if r.ContentLength > h.maxBody {
+			h.writeAndLogError(w, r, ErrTooLarge)
+			return
+		}
+		r.Body = &limitedBody{r.Body, h.maxBody}
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		h.writeAndLogError(w, r, badRequest(err))
+		return
+	}
+	defer r.Body.Close()
+	var items []batchItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		h.writeAndLogError(w, r, badRequest(err))
+		return
+	}
+	if len(items) > h.maxBatch {
+		h.writeAndLogError(w, r, ErrTooLarge)
+		return
+	}
+	results := make([]batchResult, len(items))
+	for i, item := range items {
+		atomic.AddInt64(&h.stats.requests, 1)
+		results[i] = h.runBatchItem(r, data, item)
+	}
+	data, err = json.Marshal(results)
+	if err != nil {
+		h.writeAndLogError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.writeAndLog(w, r, http.StatusOK, data)
+}
+
+// runBatchItem runs item of the batch r with body data through the
+// same per-script checks as a single request. The signature of the
+// batch stands for its items.
+func (h *Handler) runBatchItem(r *http.Request, data []byte, item batchItem) batchResult {
+	fail := func(id string, err error) batchResult {
+		atomic.AddInt64(&h.stats.errors, 1)
+		return batchError(id, err)
+	}
+	name, ok := h.scriptName(path.Join(h.rootUrl, item.Name))
+	if !ok {
+		return fail("", ErrNotFound)
+	}
+	w := &headerWriter{make(http.Header)}
+	if err := h.checkWindow(name); err != nil {
+		return fail("", err)
+	}
+	itemReq, _ := http.NewRequest(r.Method, r.URL.String(), bytes.NewReader(item.Params))
+	itemReq.Header.Set("Content-Type", "application/json")
+	if err := h.checkBody(name, itemReq); err != nil {
+		return fail("", err)
+	}
+	signed := *r
+	signed.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if err := h.verify(name, &signed); err != nil {
+		return fail("", err)
+	}
+	if err := h.checkRate(w, name); err != nil {
+		return fail("", err)
+	}
+	params := make(Params)
+	if len(bytes.TrimSpace(item.Params)) != 0 {
+		if err := h.validate(name, item.Params); err != nil {
+			return fail("", badRequest(err))
+		}
+		if err := params.AddJSONOptions(item.Params, h.jsonOpts); err != nil {
+			return fail("", badRequest(err))
+		}
+	}
+	if !item.Sync {
+		id, err := h.enqueue(name, params)
+		if err != nil {
+			return fail(id, err)
+		}
+		return batchResult{Id: id, Status: http.StatusOK}
+	}
+	release, err := h.acquire(h.ClientIP(r))
+	if err != nil {
+		return fail("", err)
+	}
+	defer release()
+	hk := h.internalHook(name, params)
+	hk.w = w
+	hk.ctx = r.Context()
+	hk.r.Header, hk.r.RemoteAddr = r.Header, r.RemoteAddr
+	status, body, err := hk.execute()
+	if err != nil {
+		return batchError(hk.id, err)
+	}
+	return batchResult{Id: hk.id, Status: status, Body: string(body)}
+}
+
+func batchError(id string, err error) batchResult {
+	return batchResult{Id: id, Status: StatusCode(err), Body: err.Error()}
+}
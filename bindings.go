@@ -0,0 +1,113 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mikespook/golib/iptpool"
+)
+
+// reserved are the names ghoko binds itself. Keep it in sync with the
+// bindings of LuaIpt.Init, Handler.onCreate and hook.bind.
+var reserved = map[string]bool{
+	"Aborted":        true,
+	"Cache":          true,
+	"Call":           true,
+	"ClientIP":       true,
+	"Coalesce":       true,
+	"Config":         true,
+	"Context":        true,
+	"Ctx":            true,
+	"Db":             true,
+	"Debug":          true,
+	"Debugf":         true,
+	"Emit":           true,
+	"Enqueue":        true,
+	"Env":            true,
+	"Error":          true,
+	"Errorf":         true,
+	"exceeded":       true,
+	"Exec":           true,
+	"Fail":           true,
+	"Get":            true,
+	"Http":           true,
+	"Id":             true,
+	"Json":           true,
+	"Len":            true,
+	"limits":         true,
+	"Lock":           true,
+	"Message":        true,
+	"Messagef":       true,
+	"Net":            true,
+	"NoContent":      true,
+	"Params":         true,
+	"Path":           true,
+	"Post":           true,
+	"PostJSON":       true,
+	"ReadFile":       true,
+	"RawBody":        true,
+	"Redirect":       true,
+	"Request":        true,
+	"Result":         true,
+	"ResultId":       true,
+	"Secret":         true,
+	"SendFile":       true,
+	"Server":         true,
+	"SetContentType": true,
+	"SetHeader":      true,
+	"SetOutcome":     true,
+	"SetParam":       true,
+	"Slice":          true,
+	"Status":         true,
+	"Time":           true,
+	"Timer":          true,
+	"ToJSON":         true,
+	"ToQuery":        true,
+	"Uptime":         true,
+	"Warning":        true,
+	"Warningf":       true,
+	"WorkDir":        true,
+	"WriteBody":      true,
+	"WriteFile":      true,
+	"WriteHeader":    true,
+	"Ws":             true,
+}
+
+// ReservedNames returns the sorted names of the bindings ghoko provides.
+func ReservedNames() []string {
+	names := make([]string, 0, len(reserved))
+	for name := range reserved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Bind adds a binding to the module table of every interpreter. It fails
+// if name is reserved or already bound, so a custom binding can not
+// clobber another one unnoticed. Call it before serving, or Reload.
+func (h *Handler) Bind(name string, item interface{}) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if reserved[name] {
+		return fmt.Errorf("binding %q is reserved", name)
+	}
+	if _, ok := h.bindings[name]; ok {
+		return fmt.Errorf("binding %q already exists", name)
+	}
+	h.bindings[name] = item
+	return nil
+}
+
+func (h *Handler) bindCustom(ipt iptpool.ScriptIpt) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for name, item := range h.bindings {
+		ipt.Bind(name, item)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"strings"
+
+	"github.com/mikespook/golib/log"
+)
+
+const redacted = "******"
+
+// SetBodyLogging logs request bodies and, for sync requests, the data
+// passed to WriteBody. At most max bytes of each are logged, zero for
+// no cap. The secret is redacted. It is off by default.
+func (h *Handler) SetBodyLogging(enabled bool, max int) {
+	h.bodyLog = enabled
+	h.bodyLogMax = max
+}
+
+func (h *Handler) redact(s string) string {
+	secret := h.currentSecret()
+	if secret == "" {
+		return s
+	}
+	return strings.Replace(s, secret, redacted, -1)
+}
+
+func (h *Handler) logBody(id, kind string, data []byte) {
+	if !h.bodyLog {
+		return
+	}
+	// Redact before truncating, or a secret cut in half would be logged.
+	s := h.redact(string(data))
+	if h.bodyLogMax > 0 && len(s) > h.bodyLogMax {
+		s = s[:h.bodyLogMax]
+	}
+	log.Messagef("%s %s (%d bytes) %q", id, kind, len(data), s)
+}
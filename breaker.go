@@ -0,0 +1,132 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"sync"
+	"time"
+)
+
+// hostGuard rate limits outbound requests and trips a circuit breaker
+// per host. Zero values disable either part.
+type hostGuard struct {
+	sync.Mutex
+	rate      float64
+	burst     int
+	threshold int
+	cooldown  time.Duration
+	hosts     map[string]*hostState
+}
+
+type hostState struct {
+	tokens    float64
+	last      time.Time
+	failures  int
+	openUntil time.Time
+	seen      time.Time
+}
+
+// maxHosts bounds the hosts a guard keeps state for, scripts can call
+// any number of them.
+const maxHosts = 1024
+
+func newHostGuard() *hostGuard {
+	return &hostGuard{hosts: make(map[string]*hostState)}
+}
+
+// SetOutboundRateLimit allows rate requests per second with bursts of
+// burst to every remote host called by Get, Post and PostJSON.
+func (h *Handler) SetOutboundRateLimit(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	h.outbound.Lock()
+	defer h.outbound.Unlock()
+	h.outbound.rate = rate
+	h.outbound.burst = burst
+}
+
+// SetCircuitBreaker short-circuits calls to a host for cooldown after
+// threshold consecutive failures. Failures are transport errors and 5xx
+// responses.
+func (h *Handler) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	h.outbound.Lock()
+	defer h.outbound.Unlock()
+	h.outbound.threshold = threshold
+	h.outbound.cooldown = cooldown
+}
+
+func (g *hostGuard) state(host string, now time.Time) *hostState {
+	s, ok := g.hosts[host]
+	if !ok {
+		if len(g.hosts) >= maxHosts {
+			g.evict(now)
+		}
+		s = &hostState{tokens: float64(g.burst), last: now}
+		g.hosts[host] = s
+	}
+	s.seen = now
+	return s
+}
+
+// evict drops the hosts at rest, whose state is the one of a new host,
+// or the least recently seen one if there are none.
+func (g *hostGuard) evict(now time.Time) {
+	var oldest string
+	for host, s := range g.hosts {
+		tokens := s.tokens + now.Sub(s.last).Seconds()*g.rate
+		if s.failures == 0 && !now.Before(s.openUntil) && (g.rate <= 0 || tokens >= float64(g.burst)) {
+			delete(g.hosts, host)
+		} else if oldest == "" || s.seen.Before(g.hosts[oldest].seen) {
+			oldest = host
+		}
+	}
+	if len(g.hosts) >= maxHosts {
+		delete(g.hosts, oldest)
+	}
+}
+
+func (g *hostGuard) allow(host string) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.rate <= 0 && g.threshold <= 0 {
+		return nil
+	}
+	now := time.Now()
+	s := g.state(host, now)
+	if g.threshold > 0 && now.Before(s.openUntil) {
+		return ErrCircuitOpen
+	}
+	if g.rate > 0 {
+		s.tokens += now.Sub(s.last).Seconds() * g.rate
+		if max := float64(g.burst); s.tokens > max {
+			s.tokens = max
+		}
+		s.last = now
+		if s.tokens < 1 {
+			return ErrRateLimited
+		}
+		s.tokens--
+	}
+	return nil
+}
+
+func (g *hostGuard) done(host string, ok bool) {
+	g.Lock()
+	defer g.Unlock()
+	if g.threshold <= 0 {
+		return
+	}
+	s := g.state(host, time.Now())
+	if ok {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if g.threshold > 0 && s.failures >= g.threshold {
+		s.openUntil = time.Now().Add(g.cooldown)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/stevedonovan/luar"
+)
+
+const defaultCacheSize = 1024
+
+// cache is an in-memory LRU cache with per-entry expiry, shared by all
+// interpreters.
+type cache struct {
+	sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// SetCacheSize bounds the number of entries of the script cache. The
+// least recently used entries are evicted first.
+func (h *Handler) SetCacheSize(n int) {
+	h.cache.Lock()
+	defer h.cache.Unlock()
+	h.cache.size = n
+	h.cache.evict()
+}
+
+func (c *cache) get(key string) interface{} {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return entry.value
+}
+
+// set stores value under key for ttl seconds, zero for no expiry.
+func (c *cache) set(key string, value interface{}, ttl float64) {
+	c.Lock()
+	defer c.Unlock()
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(time.Duration(ttl * float64(time.Second)))
+	}
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		e.Value = &cacheEntry{key, value, expires}
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, value, expires})
+	c.evict()
+}
+
+func (c *cache) delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *cache) evict() {
+	for c.size > 0 && c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *cache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+func (c *cache) binding() luar.Map {
+	return luar.Map{
+		"Get":    c.get,
+		"Set":    c.set,
+		"Delete": c.delete,
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stevedonovan/luar"
+)
+
+const defaultRetryBackoff = 500 * time.Millisecond
+
+// retryPolicy is the policy table of a ghoko.Http call.
+type retryPolicy struct {
+	attempts int
+	statuses map[int]bool
+	backoff  time.Duration
+}
+
+// newRetryPolicy reads {attempts = 3, statuses = {503}, backoff = 0.5}.
+// By default there is one attempt, and 429, 502, 503 and 504 are
+// retried with a half second backoff doubling each time.
+func newRetryPolicy(m map[string]interface{}) retryPolicy {
+	p := retryPolicy{
+		attempts: 1,
+		statuses: map[int]bool{429: true, 502: true, 503: true, 504: true},
+		backoff:  defaultRetryBackoff,
+	}
+	if n, ok := m["attempts"].(float64); ok && n >= 1 {
+		p.attempts = int(n)
+	}
+	if b, ok := m["backoff"].(float64); ok && b >= 0 {
+		p.backoff = time.Duration(b * float64(time.Second))
+	}
+	var statuses []interface{}
+	switch s := m["statuses"].(type) {
+	case []interface{}:
+		statuses = s
+	case map[string]interface{}:
+		for _, v := range s {
+			statuses = append(statuses, v)
+		}
+	}
+	if statuses != nil {
+		p.statuses = make(map[int]bool)
+		for _, v := range statuses {
+			if n, ok := v.(float64); ok {
+				p.statuses[int(n)] = true
+			}
+		}
+	}
+	return p
+}
+
+// idempotent methods are retried, others are sent once.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// retryAfter reads the Retry-After seconds of resp.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// httpBinding is ghoko.Http, whose calls are cancelled with the hook,
+// at the latest at its deadline.
+func (h *hook) httpBinding() luar.Map {
+	return luar.Map{
+		"Get": func(uri string, policy map[string]interface{}) (string, int, error) {
+			return h.request("GET", uri, "", "", policy)
+		},
+		"Request": func(method, uri, body, contentType string, policy map[string]interface{}) (string, int, error) {
+			return h.request(strings.ToUpper(method), uri, body, contentType, policy)
+		},
+	}
+}
+
+// outboundContext bounds outbound calls of the hook by its context and
+// deadline.
+func (h *hook) outboundContext() (context.Context, context.CancelFunc) {
+	if h.deadline.IsZero() {
+		return context.WithCancel(h.ctx)
+	}
+	return context.WithDeadline(h.ctx, h.deadline)
+}
+
+// request sends a request, retrying it as told by policy. It returns
+// the body and status of the last response, whatever the status is.
+func (h *hook) request(method, uri, body, contentType string, policy map[string]interface{}) (string, int, error) {
+	p := newRetryPolicy(policy)
+	if !idempotent(method) {
+		p.attempts = 1
+	}
+	ctx, cancel := h.outboundContext()
+	defer cancel()
+	backoff := p.backoff
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(method, uri, strings.NewReader(body))
+		if err != nil {
+			return "", 0, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, data, err := h.handler.send(req.WithContext(ctx))
+		if attempt >= p.attempts || ctx.Err() != nil || (err == nil && !p.statuses[resp.StatusCode]) {
+			if err != nil {
+				return "", 0, err
+			}
+			return string(data), resp.StatusCode, nil
+		}
+		wait := backoff
+		if d, ok := retryAfter(resp); ok {
+			wait = d
+		}
+		backoff *= 2
+		if dl, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(dl) {
+			if err != nil {
+				return "", 0, err
+			}
+			return string(data), resp.StatusCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// coalescer lets concurrent executions of a script sharing a coalesce
+// key wait for the first one and reuse its result. It works like
+// singleflight, except the shared work is the rest of the leading
+// script instead of a Go function, so singleflight.Group, which runs
+// the function of its first caller, does not fit.
+type coalescer struct {
+	sync.Mutex
+	calls map[string]*coalesceCall
+}
+
+type coalesceCall struct {
+	done   chan struct{}
+	status int
+	body   []byte
+	header http.Header
+	err    error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*coalesceCall)}
+}
+
+// join returns the in-flight call for key, and whether the caller
+// leads it.
+func (c *coalescer) join(key string) (*coalesceCall, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+	call := &coalesceCall{done: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+func (c *coalescer) finish(key string, call *coalesceCall) {
+	c.Lock()
+	delete(c.calls, key)
+	c.Unlock()
+	close(call.done)
+}
+
+// coalesce implements the Coalesce binding. It returns true when the
+// hook follows another execution and its script should return right
+// away. The hook waits for the result in settle, once its interpreter is
+// back in the pool.
+func (h *hook) coalesce(key string) bool {
+	if h.streaming {
+		return false
+	}
+	if h.leading != nil || h.shared != nil {
+		return h.shared != nil
+	}
+	h.coalesceKey = h.name + "\x00" + key
+	call, leader := h.handler.coalescer.join(h.coalesceKey)
+	if leader {
+		h.leading = call
+		return false
+	}
+	h.shared = call
+	return true
+}
+
+// settle publishes the result of a leading hook to its followers, or
+// replaces the result of a following hook with the shared one. Waiting
+// for it is bounded by the deadline of the hook and its client.
+func (h *hook) settle(status int, data []byte, err error) (int, []byte, error) {
+	if call := h.leading; call != nil {
+		call.status, call.body, call.err = status, data, err
+		if h.isSync {
+			call.header = h.w.Header().Clone()
+		}
+		h.handler.coalescer.finish(h.coalesceKey, call)
+		return status, data, err
+	}
+	if call := h.shared; call != nil {
+		var expired <-chan time.Time
+		if !h.deadline.IsZero() {
+			t := time.NewTimer(time.Until(h.deadline))
+			defer t.Stop()
+			expired = t.C
+		}
+		select {
+		case <-call.done:
+		case <-expired:
+			return http.StatusGatewayTimeout, nil, ErrTimeout
+		case <-h.ctx.Done():
+			return statusClientClosed, nil, h.ctx.Err()
+		}
+		if h.isSync {
+			for k, v := range call.header {
+				h.w.Header()[k] = append([]string(nil), v...)
+			}
+		}
+		return call.status, call.body, call.err
+	}
+	return status, data, err
+}
@@ -0,0 +1,84 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inFlight counts the executions in progress, in total and per client.
+type inFlight struct {
+	total int64 // first for 64-bit atomic alignment
+	mu    sync.Mutex
+	perIP map[string]int
+}
+
+// SetMaxConcurrency refuses requests with 503 while n executions are in
+// progress, async ones included. Zero means no limit.
+func (h *Handler) SetMaxConcurrency(n int) {
+	h.maxConcurrency = int64(n)
+}
+
+// SetMaxPerIPConcurrency refuses requests with 429 while n executions
+// of the same client IP are in progress. Zero means no limit.
+func (h *Handler) SetMaxPerIPConcurrency(n int) {
+	h.maxPerIP = n
+}
+
+const defaultOutboundTimeout = 30 * time.Second
+
+// SetOutboundTimeout bounds every outbound request of scripts to d, on
+// top of the deadline of the script. Zero keeps the default of 30
+// seconds.
+func (h *Handler) SetOutboundTimeout(d time.Duration) {
+	if d == 0 {
+		d = defaultOutboundTimeout
+	}
+	h.client = &http.Client{Timeout: d}
+}
+
+// SetMaxOutboundConcurrency lets at most n requests of Get, Post and
+// PostJSON be in progress at once, the rest wait for a slot. So a large
+// fan-out does not eat the connections and time inbound hooks need.
+// Zero means no limit. Call it before serving.
+func (h *Handler) SetMaxOutboundConcurrency(n int) {
+	h.outboundSlots = nil
+	if n > 0 {
+		h.outboundSlots = make(chan struct{}, n)
+	}
+}
+
+// acquire takes a slot for an execution of ip, and returns the func to
+// give it back.
+func (h *Handler) acquire(ip string) (func(), error) {
+	f := h.inFlight
+	if n := atomic.AddInt64(&f.total, 1); h.maxConcurrency > 0 && n > h.maxConcurrency {
+		atomic.AddInt64(&f.total, -1)
+		return nil, ErrOverloaded
+	}
+	if h.maxPerIP <= 0 {
+		return func() { atomic.AddInt64(&f.total, -1) }, nil
+	}
+	f.mu.Lock()
+	if f.perIP[ip] >= h.maxPerIP {
+		f.mu.Unlock()
+		atomic.AddInt64(&f.total, -1)
+		return nil, ErrTooManyRequests
+	}
+	f.perIP[ip]++
+	f.mu.Unlock()
+	return func() {
+		f.mu.Lock()
+		if f.perIP[ip]--; f.perIP[ip] <= 0 {
+			delete(f.perIP, ip)
+		}
+		f.mu.Unlock()
+		atomic.AddInt64(&f.total, -1)
+	}, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/mikespook/golib/log"
+	"github.com/stevedonovan/luar"
+)
+
+// Config holds the per-script settings loaded by LoadConfig.
+type Config struct {
+	// Secret replaces the secret of the handler, if not empty.
+	Secret string `json:"secret"`
+	// AllowedScripts replaces the allowed scripts, if not nil.
+	AllowedScripts []string `json:"allowed_scripts"`
+	// Aliases are added like SetAlias, and removed again once dropped
+	// from the file.
+	Aliases map[string]AliasConfig  `json:"aliases"`
+	Scripts map[string]ScriptConfig `json:"scripts"`
+	// Settings is structured config for scripts, see ghoko.Config.
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// AliasConfig is an alias of Config.
+type AliasConfig struct {
+	Name     string `json:"name"`
+	Redirect bool   `json:"redirect"`
+}
+
+// ScriptConfig is the settings of one script. Absent fields, empty
+// strings and nil ones, keep what the handler has, e.g. from setters.
+type ScriptConfig struct {
+	// Timeout is a duration like "30s".
+	Timeout string `json:"timeout"`
+	// Sync is "client", "always" or "never".
+	Sync string `json:"sync"`
+	// Secrets are the signature secrets of the script.
+	Secrets      []string `json:"secrets"`
+	MaxBody      *int64   `json:"max_body"`
+	ContentTypes []string `json:"content_types"`
+	Priority     *int     `json:"priority"`
+	Streaming    *bool    `json:"streaming"`
+	NoContent    *bool    `json:"no_content"`
+	// RateLimit is in requests per second, with bursts of Burst.
+	RateLimit *float64 `json:"rate_limit"`
+	Burst     int      `json:"burst"`
+	// LogLevel is "debug", "message", "warning", "error" or "none".
+	LogLevel string `json:"log_level"`
+}
+
+var syncModes = map[string]SyncMode{
+	"":       SyncByClient,
+	"client": SyncByClient,
+	"always": SyncAlways,
+	"never":  SyncNever,
+}
+
+var logLevels = map[string]LogLevel{
+	"":        LogDefault,
+	"debug":   LogDebug,
+	"message": LogMessage,
+	"warning": LogWarning,
+	"error":   LogError,
+	"none":    LogNone,
+}
+
+// LoadConfig reads the JSON config file p and applies it. Reload reads
+// it again, settings dropped from the file get their defaults back.
+func (h *Handler) LoadConfig(p string) error {
+	cfg, err := readConfig(p)
+	if err != nil {
+		return err
+	}
+	h.applyConfig(cfg)
+	h.configPath = p
+	return nil
+}
+
+func readConfig(p string) (*Config, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", p, err)
+	}
+	for name, sc := range cfg.Scripts {
+		if sc.Timeout != "" {
+			if _, err := time.ParseDuration(sc.Timeout); err != nil {
+				return nil, fmt.Errorf("%s: script %q: %s", p, name, err)
+			}
+		}
+		if _, ok := syncModes[sc.Sync]; !ok {
+			return nil, fmt.Errorf("%s: script %q: unknown sync mode %q", p, name, sc.Sync)
+		}
+		if _, ok := logLevels[sc.LogLevel]; !ok {
+			return nil, fmt.Errorf("%s: script %q: unknown log level %q", p, name, sc.LogLevel)
+		}
+	}
+	return &cfg, nil
+}
+
+func (h *Handler) applyConfig(cfg *Config) {
+	for name, old := range h.configured {
+		h.unsetScriptConfig(name, old, cfg.Scripts[name])
+	}
+	h.configured = make(map[string]ScriptConfig, len(cfg.Scripts))
+	for name, sc := range cfg.Scripts {
+		h.applyScriptConfig(name, sc)
+		h.configured[name] = sc
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cfg.Secret != "" {
+		h.secret = cfg.Secret
+	}
+	if cfg.AllowedScripts != nil {
+		h.allowedScripts = make(map[string]bool, len(cfg.AllowedScripts))
+		for _, name := range cfg.AllowedScripts {
+			h.allowedScripts[name] = true
+		}
+	}
+	for old := range h.configAliases {
+		if _, ok := cfg.Aliases[old]; !ok {
+			delete(h.aliases, old)
+		}
+	}
+	h.configAliases = make(map[string]bool, len(cfg.Aliases))
+	for old, a := range cfg.Aliases {
+		h.aliases[old] = alias{a.Name, a.Redirect}
+		h.configAliases[old] = true
+	}
+	h.settings = cfg.Settings
+}
+
+// configBinding is ghoko.Config, a copy of the settings so changes made
+// by a script do not reach other requests.
+func (h *Handler) configBinding() luar.Map {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return luar.Map(deepCopy(h.settings).(map[string]interface{}))
+}
+
+// deepCopy copies the objects and arrays of a decoded JSON value.
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = deepCopy(item)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, item := range v {
+			s[i] = deepCopy(item)
+		}
+		return s
+	}
+	return v
+}
+
+// applyScriptConfig applies the fields present in sc to the script name.
+func (h *Handler) applyScriptConfig(name string, sc ScriptConfig) {
+	var limiter *bucket
+	if sc.RateLimit != nil {
+		limiter = newBucket(*sc.RateLimit, sc.Burst)
+	}
+	h.updateOptions(name, func(opts *scriptOptions) {
+		if sc.Timeout != "" {
+			opts.timeout, _ = time.ParseDuration(sc.Timeout)
+		}
+		if sc.Sync != "" {
+			opts.syncMode = syncModes[sc.Sync]
+		}
+		if sc.Secrets != nil {
+			opts.signSecrets = sc.Secrets
+		}
+		if sc.MaxBody != nil {
+			opts.maxBody = *sc.MaxBody
+		}
+		if sc.ContentTypes != nil {
+			opts.contentTypes = sc.ContentTypes
+		}
+		if sc.Priority != nil {
+			opts.priority = *sc.Priority
+		}
+		if sc.Streaming != nil {
+			opts.streaming = *sc.Streaming
+		}
+		if sc.NoContent != nil {
+			opts.noContent = *sc.NoContent
+		}
+		if sc.RateLimit != nil {
+			opts.limiter = limiter
+		}
+		if sc.LogLevel != "" {
+			opts.logLevel = logLevels[sc.LogLevel]
+		}
+	})
+}
+
+// unsetScriptConfig resets the fields the old config of the script name
+// set and sc does not.
+func (h *Handler) unsetScriptConfig(name string, old, sc ScriptConfig) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		if old.Timeout != "" && sc.Timeout == "" {
+			opts.timeout = 0
+		}
+		if old.Sync != "" && sc.Sync == "" {
+			opts.syncMode = SyncByClient
+		}
+		if old.Secrets != nil && sc.Secrets == nil {
+			opts.signSecrets = nil
+		}
+		if old.MaxBody != nil && sc.MaxBody == nil {
+			opts.maxBody = 0
+		}
+		if old.ContentTypes != nil && sc.ContentTypes == nil {
+			opts.contentTypes = nil
+		}
+		if old.Priority != nil && sc.Priority == nil {
+			opts.priority = 0
+		}
+		if old.Streaming != nil && sc.Streaming == nil {
+			opts.streaming = false
+		}
+		if old.NoContent != nil && sc.NoContent == nil {
+			opts.noContent = false
+		}
+		if old.RateLimit != nil && sc.RateLimit == nil {
+			opts.limiter = nil
+		}
+		if old.LogLevel != "" && sc.LogLevel == "" {
+			opts.logLevel = LogDefault
+		}
+	})
+}
+
+// reloadConfig reads the config file again, keeping the current one if
+// it is broken.
+func (h *Handler) reloadConfig() {
+	if h.configPath == "" {
+		return
+	}
+	cfg, err := readConfig(h.configPath)
+	if err != nil {
+		log.Errorf("Reload config: %s", err)
+		return
+	}
+	h.applyConfig(cfg)
+}
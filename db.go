@@ -0,0 +1,137 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/stevedonovan/luar"
+)
+
+// SetDatabasePolicy sets what SetDatabase does when the database can not
+// be reached. The default is BackendRequired.
+func (h *Handler) SetDatabasePolicy(policy BackendPolicy) {
+	h.dbPolicy = policy
+}
+
+// SetDatabase opens the connection pool used by the Db binding. The
+// driver has to be registered by the program, e.g. by importing
+// _ "github.com/lib/pq". Every query is cancelled after timeout, or
+// when the request it belongs to is gone; zero means no timeout.
+func (h *Handler) SetDatabase(driver, dsn string, timeout time.Duration) error {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	if err := h.dbBackend.setup(h.dbPolicy, func() error { return pingDatabase(db, timeout) }); err != nil {
+		db.Close()
+		return err
+	}
+	if h.db != nil {
+		h.db.Close()
+	}
+	h.db = db
+	h.dbTimeout = timeout
+	return nil
+}
+
+func pingDatabase(db *sql.DB, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return db.PingContext(ctx)
+}
+
+// closeDatabase stops reconnecting and closes the database, if any.
+func (h *Handler) closeDatabase() {
+	h.dbBackend.stop()
+	if h.db != nil {
+		h.db.Close()
+	}
+}
+
+// database returns the database for a call of the Db binding.
+func (h *Handler) database() (*sql.DB, error) {
+	if h.db == nil {
+		return nil, ErrNoDatabase
+	}
+	if err := h.dbBackend.check(); err != nil {
+		return nil, err
+	}
+	return h.db, nil
+}
+
+func (h *hook) dbContext() (context.Context, context.CancelFunc) {
+	if h.handler.dbTimeout > 0 {
+		return context.WithTimeout(h.ctx, h.handler.dbTimeout)
+	}
+	return context.WithCancel(h.ctx)
+}
+
+func (h *hook) dbQuery(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	db, err := h.handler.database()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := h.dbContext()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			if b, ok := values[i].([]byte); ok {
+				row[col] = string(b)
+			} else {
+				row[col] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func (h *hook) dbExec(query string, args ...interface{}) (int64, error) {
+	db, err := h.handler.database()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := h.dbContext()
+	defer cancel()
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (h *hook) dbBinding() luar.Map {
+	return luar.Map{
+		"Query": h.dbQuery,
+		"Exec":  h.dbExec,
+	}
+}
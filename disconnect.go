@@ -0,0 +1,26 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"errors"
+	"syscall"
+)
+
+// statusClientClosed is logged for sync requests whose client went away
+// before the response, like nginx does.
+const statusClientClosed = 499
+
+// aborted reports whether the client of a sync request disconnected.
+func (h *hook) aborted() bool {
+	return h.isSync && h.ctx.Err() != nil
+}
+
+// isDisconnect reports whether err comes from writing to a client which
+// closed the connection.
+func isDisconnect(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
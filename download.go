@@ -0,0 +1,91 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// SetDownloadDir is the directory the SendFile binding may send files
+// from. Empty, the default, disables SendFile.
+func (h *Handler) SetDownloadDir(dir string) {
+	if dir == "" {
+		h.downloadDir = ""
+		return
+	}
+	h.downloadDir = filepath.Clean(dir)
+}
+
+// sendFile implements the SendFile binding. The file is only sent once
+// the script succeeded, in place of the body.
+func (h *hook) sendFile(p string) error {
+	if !h.isSync {
+		return ErrSyncNeeded
+	}
+	if h.handler.downloadDir == "" {
+		return ErrNoDownloadDir
+	}
+	if h.body.Len() > 0 || h.streamed || h.redirected {
+		return ErrBodyWritten
+	}
+	f, err := workDir(h.handler.downloadDir).resolve(p)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(f)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return ErrNotAFile
+	}
+	if max := h.handler.maxResponse; max > 0 && fi.Size() > max {
+		return ErrResponseTooLarge
+	}
+	h.download = f
+	return nil
+}
+
+// writeFile sends the file of SendFile to the client.
+func (h *hook) writeFile() error {
+	f, err := os.Open(h.download)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := h.w.Header()
+	if header.Get("Content-Type") == "" {
+		ct := mime.TypeByExtension(filepath.Ext(h.download))
+		if ct == "" {
+			buf := make([]byte, 512)
+			n, _ := io.ReadFull(f, buf)
+			ct = http.DetectContentType(buf[:n])
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		header.Set("Content-Type", ct)
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": filepath.Base(h.download)}))
+	header.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	h.w.WriteHeader(h.status)
+	h.streamed = true
+	if h.r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = io.Copy(h.w, f)
+	return err
+}
@@ -1,11 +1,54 @@
 package ghoko
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+)
 
 var (
-	ErrSyncNeeded = &HttpError{http.StatusBadRequest, "`Ghoko-sync` header needed"}
-	ErrForbidden  = &HttpError{http.StatusForbidden, "Incorrect `_secret` parameter"}
-	ErrNotFound   = &HttpError{http.StatusNotFound, "Request path was not found"}
+	ErrNoWorkDir        = errors.New("Working directory was not configured")
+	ErrOutsideWorkDir   = errors.New("Path is outside of the working directory")
+	ErrRateLimited      = errors.New("Outbound rate limit exceeded")
+	ErrCircuitOpen      = errors.New("Circuit breaker is open")
+	ErrNoDatabase       = errors.New("Database was not configured")
+	ErrBadTTL           = errors.New("Lock TTL must be positive")
+	ErrStatusNotAllowed = errors.New("Status is not allowed")
+	ErrDrainTimeout     = errors.New("Executions did not finish in time")
+	ErrBackendDown      = errors.New("Backend is down, reconnecting")
+	ErrInvalidHeader    = errors.New("Invalid or reserved header")
+	ErrUndecryptable    = errors.New("Payload could not be decrypted")
+	ErrUnknownProfile   = errors.New("Profile was not added")
+	ErrNotRedirect      = errors.New("Status is not a redirect")
+	ErrBodyWritten      = errors.New("Body was written already")
+	ErrRedirected       = errors.New("Response is a redirect")
+	ErrInvalidOutcome   = errors.New("Outcome must be a short token")
+	ErrHeaderSent       = errors.New("Header was sent already")
+	ErrNoDownloadDir    = errors.New("Download directory was not configured")
+	ErrNotAFile         = errors.New("Not a regular file")
+)
+
+var (
+	ErrSyncNeeded        = &HttpError{http.StatusBadRequest, "`Ghoko-sync` header needed"}
+	ErrForbidden         = &HttpError{http.StatusForbidden, "Incorrect secret"}
+	ErrNotFound          = &HttpError{http.StatusNotFound, "Request path was not found"}
+	ErrParamsLimit       = &HttpError{http.StatusBadRequest, "Too many or too deeply nested params"}
+	ErrBadRequest        = &HttpError{http.StatusBadRequest, "Bad request"}
+	ErrMaintenance       = &HttpError{http.StatusServiceUnavailable, "Under maintenance"}
+	ErrTimeout           = &HttpError{http.StatusGatewayTimeout, "Script timed out"}
+	ErrOverloaded        = &HttpError{http.StatusServiceUnavailable, "Too many requests in progress"}
+	ErrTooManyRequests   = &HttpError{http.StatusTooManyRequests, "Too many requests in progress for the client"}
+	ErrBadSignature      = &HttpError{http.StatusUnauthorized, "Invalid signature"}
+	ErrStaleSignature    = &HttpError{http.StatusUnauthorized, "Timestamp outside of tolerance"}
+	ErrClosed            = &HttpError{http.StatusServiceUnavailable, "Shutting down"}
+	ErrScriptRateLimited = &HttpError{http.StatusTooManyRequests, "Too many requests for the script"}
+	ErrNotPublished      = &HttpError{http.StatusServiceUnavailable, "Delivery could not be queued"}
+	ErrQueueFull         = &HttpError{http.StatusServiceUnavailable, "Too many async executions queued"}
+	ErrMemoryLimit       = &HttpError{http.StatusInternalServerError, "Script memory limit exceeded"}
+	ErrNoStreaming       = &HttpError{http.StatusInternalServerError, "Streaming is not supported"}
+	ErrUnavailable       = &HttpError{http.StatusServiceUnavailable, "No interpreter available"}
+	ErrResponseTooLarge  = &HttpError{http.StatusInternalServerError, "Response too large"}
+	ErrTooLarge          = &HttpError{http.StatusRequestEntityTooLarge, "Request body too large"}
+	ErrUnsupportedType   = &HttpError{http.StatusUnsupportedMediaType, "Unsupported content type"}
 )
 
 type HttpError struct {
@@ -16,3 +59,37 @@ type HttpError struct {
 func (err *HttpError) Error() string {
 	return err.message
 }
+
+// Status is the HTTP status err is answered with.
+func (err *HttpError) Status() int {
+	return err.status
+}
+
+// StatusCode is the HTTP status a request failing with err gets: the one
+// of an HttpError or InvalidPayload anywhere in the chain of err, which
+// sentinels like ErrSyncNeeded are, and 500 for others. Sentinels can be
+// told apart with errors.Is. A nil err is 200.
+func StatusCode(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	var he *HttpError
+	if errors.As(err, &he) {
+		return he.status
+	}
+	var ip *InvalidPayload
+	if errors.As(err, &ip) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// badRequest turns err into a 400, unless it carries a status already.
+func badRequest(err error) error {
+	var he *HttpError
+	var ip *InvalidPayload
+	if errors.As(err, &he) || errors.As(err, &ip) {
+		return err
+	}
+	return &HttpError{http.StatusBadRequest, err.Error()}
+}
@@ -0,0 +1,109 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mikespook/golib/log"
+)
+
+// eventBuffer is the number of events a subscriber may lag behind
+// before events are dropped for it.
+const eventBuffer = 64
+
+// event is sent to the subscribers of /events.
+type event struct {
+	kind    string
+	Id      string      `json:"id"`
+	Name    string      `json:"name"`
+	Status  int         `json:"status,omitempty"`
+	Outcome string      `json:"outcome,omitempty"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// broker fans events out to subscribers without ever blocking the
+// publisher: slow subscribers miss events instead.
+type broker struct {
+	sync.Mutex
+	subs map[chan []byte]bool
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[chan []byte]bool)}
+}
+
+func (b *broker) subscribe() chan []byte {
+	ch := make(chan []byte, eventBuffer)
+	b.Lock()
+	b.subs[ch] = true
+	b.Unlock()
+	return ch
+}
+
+func (b *broker) unsubscribe(ch chan []byte) {
+	b.Lock()
+	delete(b.subs, ch)
+	b.Unlock()
+}
+
+func (b *broker) publish(e event) {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.subs) == 0 {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("%s Event: %s", e.Id, err)
+		return
+	}
+	msg := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", e.kind, data))
+	for ch := range b.subs {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// serveEvents streams an execution event per hook and the events of
+// ghoko.Emit as Server-Sent Events until the client goes away.
+func (h *Handler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		h.writeAndLogError(w, r, ErrNoStreaming)
+		return
+	}
+	ch := h.events.subscribe()
+	defer h.events.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	h.accessf("%s %s %q %d subscribed", h.ClientIP(r), r.Method, h.redact(r.URL.String()), http.StatusOK)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-ch:
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
+
+// emit is the Emit binding, sending data to the subscribers of /events.
+func (h *hook) emit(data interface{}) {
+	h.handler.events.publish(event{kind: "script", Id: h.id, Name: h.name, Time: time.Now(), Data: data})
+}
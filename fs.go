@@ -0,0 +1,65 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// NewHookFS returns a Handler loading the scripts from an fs.FS, e.g.
+// an embed.FS, instead of a directory on disk. addr is where the hooks
+// are served, the root URL of New; of a full URL like
+// "https://example.com/hook" only the path is used.
+func NewHookFS(addr string, scripts fs.FS, secret string) *Handler {
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		addr = u.Path
+	}
+	h := New(".", secret, addr)
+	h.scriptFS = scripts
+	return h
+}
+
+// fsLoader is implemented by interpreters that can load scripts from
+// an fs.FS.
+type fsLoader interface {
+	SetFS(fsys fs.FS)
+}
+
+// checkScripts fails if the scripts can not be loaded, e.g. because the
+// directory is gone.
+func (h *Handler) checkScripts() error {
+	var fi os.FileInfo
+	var err error
+	if h.scriptFS != nil {
+		fi, err = fs.Stat(h.scriptFS, ".")
+	} else {
+		fi, err = os.Stat(h.scriptPath)
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", h.scriptPath)
+	}
+	return nil
+}
+
+// scriptFile returns the file of the script name, absolute when it is
+// on disk.
+func (h *Handler) scriptFile(name string) string {
+	if h.scriptFS != nil {
+		return name + ".lua"
+	}
+	f := filepath.Join(h.scriptPath, name+".lua")
+	if abs, err := filepath.Abs(f); err == nil {
+		return abs
+	}
+	return f
+}
@@ -10,11 +10,15 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mikespook/ghoko"
 	"github.com/mikespook/golib/log"
 	"github.com/mikespook/golib/pid"
 	"github.com/mikespook/golib/signal"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
@@ -25,6 +29,17 @@ var (
 	tlsKey     string
 	pidFile    string
 	rootUrl    string
+	accessLog  string
+	accessSize int64
+	accessAge  time.Duration
+	shutdown   string
+	startup    string
+	startupReq bool
+	keepAlive  bool
+	idleTime   time.Duration
+	autoTLS    string
+	autoCache  string
+	configFile string
 )
 
 func init() {
@@ -36,13 +51,30 @@ func init() {
 		flag.StringVar(&tlsKey, "tls-key", "", "TLS key file")
 		flag.StringVar(&pidFile, "pid", "", "PID file")
 		flag.StringVar(&rootUrl, "root", "/", "Root path of URL")
+		flag.StringVar(&accessLog, "access-log", "", "Access log to write ('stdout', 'stderr', empty for the general log)")
+		flag.Int64Var(&accessSize, "access-log-size", 0, "Rotate the access log at this size in bytes")
+		flag.DurationVar(&accessAge, "access-log-age", 0, "Rotate the access log at this age")
+		flag.StringVar(&shutdown, "shutdown", "", "Script to evaluate on shutdown")
+		flag.StringVar(&startup, "startup", "", "Script to evaluate before serving")
+		flag.BoolVar(&startupReq, "startup-required", false, "Exit if the startup script failed")
+		flag.BoolVar(&keepAlive, "keepalive", true, "Keep connections open between requests")
+		flag.DurationVar(&idleTime, "idle-timeout", 0, "Close kept-alive connections idle this long")
+		flag.StringVar(&autoTLS, "autocert", "", "Comma separated domains to get Let's Encrypt certificates for")
+		flag.StringVar(&configFile, "config", "", "JSON file with per-script settings, read again on SIGHUP")
+		flag.StringVar(&autoCache, "autocert-cache", "autocert", "Directory to cache certificates in")
 		flag.Parse()
 	}
 	log.InitWithFlag()
 }
 
 func main() {
-	log.Messagef("Starting: webhook=%q script=%q", ghoko.CallbackUrl(tlsCert, tlsKey, addr, rootUrl), scriptPath)
+	webhook := ghoko.CallbackUrl(tlsCert, tlsKey, addr, rootUrl)
+	var domains []string
+	if autoTLS != "" {
+		domains = strings.Split(autoTLS, ",")
+		webhook = "https://" + domains[0] + path.Clean(path.Join("/", rootUrl, "/"))
+	}
+	log.Messagef("Starting: webhook=%q script=%q", webhook, scriptPath)
 	if pidFile != "" {
 		if p, err := pid.New(pidFile); err != nil {
 			log.Error(err)
@@ -62,17 +94,59 @@ func main() {
 	// Begin
 	p := path.Clean(scriptPath)
 	ghk := ghoko.New(p, secret, rootUrl)
+	if configFile != "" {
+		if err := ghk.LoadConfig(configFile); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	if err := ghk.SetAccessLog(accessLog, accessSize, accessAge); err != nil {
+		log.Error(err)
+		return
+	}
+	ghk.SetShutdownScript(shutdown)
+	ghk.SetStartupScript(startup)
+	if err := ghk.Start(); err != nil && startupReq {
+		// Not started, so there is nothing to announce or drain.
+		return
+	}
+	defer func() {
+		if err := ghk.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
 	go func() {
 		defer func() {
 			if err := signal.Send(os.Getpid(), os.Interrupt); err != nil {
 				panic(err)
 			}
 		}()
+		srv := &http.Server{
+			Addr:        addr,
+			Handler:     ghk,
+			IdleTimeout: idleTime,
+		}
+		srv.SetKeepAlivesEnabled(keepAlive)
 		var err error
-		if tlsCert == "" || tlsKey == "" {
-			err = http.ListenAndServe(addr, ghk)
-		} else {
-			err = http.ListenAndServeTLS(addr, tlsCert, tlsKey, ghk)
+		switch {
+		case domains != nil:
+			m := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(domains...),
+				Cache:      autocert.DirCache(autoCache),
+			}
+			go func() {
+				if err := http.ListenAndServe(":80", m.HTTPHandler(nil)); err != nil {
+					log.Error(err)
+				}
+			}()
+			srv.Addr = ":443"
+			srv.TLSConfig = m.TLSConfig()
+			err = srv.ListenAndServeTLS("", "")
+		case tlsCert == "" || tlsKey == "":
+			err = srv.ListenAndServe()
+		default:
+			err = srv.ListenAndServeTLS(tlsCert, tlsKey)
 		}
 		if err != nil {
 			log.Error(err)
@@ -82,5 +156,10 @@ func main() {
 
 	sh := signal.NewHandler()
 	sh.Bind(os.Interrupt, func() bool { return true })
+	sh.Bind(syscall.SIGHUP, func() bool {
+		log.Message("Reloading")
+		ghk.Reload()
+		return false
+	})
 	sh.Loop()
 }
@@ -0,0 +1,59 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GraceResponse replaces the response to a client told to come back
+// later, e.g. because of maintenance or too many requests.
+type GraceResponse struct {
+	// Body replaces the message of the error, if not empty.
+	Body string
+	// RetryAfter is sent as the Retry-After header, if not zero.
+	RetryAfter time.Duration
+	// JSON sends the body as {"status": 503, "message": body}.
+	JSON bool
+}
+
+// SetGraceResponse answers requests failing with err, one of
+// ErrMaintenance, ErrOverloaded, ErrTooManyRequests, ErrUnavailable and
+// ErrClosed, with g. Maintenance is answered with a Retry-After of a
+// minute by default.
+func (h *Handler) SetGraceResponse(err *HttpError, g GraceResponse) {
+	h.grace[err] = g
+}
+
+// writeGrace writes the grace response of err, if there is one and a
+// client to send it to. Async failures have none.
+func (h *Handler) writeGrace(w http.ResponseWriter, r *http.Request, err *HttpError) bool {
+	g, ok := h.grace[err]
+	if !ok || w == nil {
+		return false
+	}
+	if g.RetryAfter > 0 {
+		secs := int64((g.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+	body := g.Body
+	if body == "" {
+		body = err.message
+	}
+	data := []byte(body)
+	if g.JSON {
+		data, _ = json.Marshal(struct {
+			Status  int    `json:"status"`
+			Message string `json:"message"`
+		}{err.status, body})
+		w.Header().Set("Content-Type", "application/json")
+	}
+	h.writeAndLog(w, r, err.status, data)
+	return true
+}
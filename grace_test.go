@@ -0,0 +1,32 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGraceResponseWithoutClient(t *testing.T) {
+	h := New(".", "secret", "/")
+	h.SetGraceResponse(ErrUnavailable, GraceResponse{Body: "later", RetryAfter: time.Second})
+	r := httptest.NewRequest("POST", "/hook", nil)
+	// Async failures are logged without a ResponseWriter.
+	h.writeAndLogError(nil, r, ErrUnavailable)
+
+	w := httptest.NewRecorder()
+	h.writeAndLogError(w, r, ErrUnavailable)
+	if w.Code != ErrUnavailable.status {
+		t.Errorf("status = %d, want %d", w.Code, ErrUnavailable.status)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want %q", got, "1")
+	}
+	if got := w.Body.String(); got != "later" {
+		t.Errorf("body = %q, want %q", got, "later")
+	}
+}
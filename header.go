@@ -0,0 +1,57 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHop are headers scripts may not set: they describe the
+// connection rather than the response, or are managed by ghoko.
+var hopByHop = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// setHeader implements the SetHeader binding.
+func (h *hook) setHeader(name, value string) error {
+	if !h.isSync {
+		return ErrSyncNeeded
+	}
+	if h.streamed {
+		return ErrHeaderSent
+	}
+	if !isToken(name) || strings.ContainsAny(value, "\r\n") {
+		return ErrInvalidHeader
+	}
+	name = http.CanonicalHeaderKey(name)
+	if hopByHop[name] {
+		return ErrInvalidHeader
+	}
+	h.w.Header().Set(name, value)
+	return nil
+}
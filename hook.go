@@ -2,105 +2,519 @@ package ghoko
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikespook/golib/iptpool"
+	"github.com/mikespook/golib/log"
+	"github.com/stevedonovan/luar"
 )
 
 type hook struct {
-	id      string
-	isJson  bool
-	isSync  bool
-	w       http.ResponseWriter
-	r       *http.Request
-	params  Params
-	name    string
-	handler *Handler
+	ctx        context.Context
+	id         string
+	isJson     bool
+	isSync     bool
+	w          http.ResponseWriter
+	r          *http.Request
+	params     Params
+	name       string
+	handler    *Handler
+	status     int
+	body       bytes.Buffer
+	failure    *HttpError
+	timeout    time.Duration
+	redirected bool
+	release    func()
+	streaming  bool
+	streamed   bool
+	written    int64
+	download   string
+	empty      bool
+	isRaw      bool
+	raw        []byte
+	target     string
+	worker     int64
+	deadline   time.Time
+	received   int64
+	locks      sync.Map
+	lockOwner  string
+	resultId   string
+	// cancel ends ctx of sync hooks once their client can not be
+	// written to anymore.
+	cancel   context.CancelFunc
+	writeErr error
+	outcome  string
+	// scratch is shared by bindings and the script for one execution.
+	scratch luar.Map
+
+	coalesceKey string
+	leading     *coalesceCall
+	shared      *coalesceCall
+	// bindExtra binds what only some entry points offer, e.g. ghoko.Ws.
+	bindExtra func(iptpool.ScriptIpt)
+	// pending is the JSON body until it is decoded into params, with
+	// the resolver params overriding it once it is.
+	pending   []byte
+	overrides Params
+	paramsErr error
 }
 
 func newHook(handler *Handler, w http.ResponseWriter, r *http.Request) (*hook, error) {
-	id := r.Header.Get("Ghoko-Id")
-	if id == "" {
-		id = handler.idgen.Id().(string)
+	name, resolved, err := handler.resolve(r)
+	if err != nil {
+		return nil, err
+	}
+	return newHookFor(handler, w, r, name, resolved)
+}
+
+// newHookFor is newHook for the script name already resolved from r,
+// with the params the resolution added.
+func newHookFor(handler *Handler, w http.ResponseWriter, r *http.Request, name string, resolved Params) (*hook, error) {
+	id := handler.requestId(r)
+	target := name
+	isRaw := handler.rawHandler != "" && !nativeType(r)
+	if isRaw {
+		name = handler.rawHandler
+	}
+	if err := handler.checkWindow(name); err != nil {
+		return nil, err
+	}
+	if err := handler.checkBody(name, r); err != nil {
+		return nil, err
 	}
-	if !strings.HasPrefix(r.URL.Path, handler.rootUrl) {
-		return nil, ErrNotFound
+	if err := handler.verify(name, r); err != nil {
+		return nil, err
+	}
+	// Only verified requests take from the bucket of the script, so
+	// unsigned ones can not lock senders out.
+	if err := handler.checkRate(w, name); err != nil {
+		return nil, err
 	}
-	name := strings.TrimPrefix(r.URL.Path, handler.rootUrl)
 	h := &hook{
-		w:       w,
-		r:       r,
-		params:  make(Params),
-		isJson:  strings.Contains(r.Header.Get("Content-Type"), "json"),
-		isSync:  r.Header.Get("Ghoko-Sync") == "true",
-		name:    name,
-		handler: handler,
-		id:      id,
+		w:         w,
+		r:         r,
+		params:    make(Params),
+		isJson:    !isRaw && strings.Contains(r.Header.Get("Content-Type"), "json"),
+		isRaw:     isRaw,
+		target:    target,
+		isSync:    handler.isSync(name, r.Header.Get("Ghoko-Sync") == "true"),
+		streaming: handler.lookup(name).streaming,
+		name:      name,
+		handler:   handler,
+		id:        id,
+		status:    http.StatusOK,
+		ctx:       context.Background(),
 	}
-	if h.isJson {
+	if h.isSync {
+		h.ctx, h.cancel = context.WithCancel(r.Context())
+	}
+	// With deep merge the params of the resolver are the base the body
+	// merges into, otherwise they override it.
+	merged := handler.jsonOpts.DeepMerge && h.isJson
+	if merged {
+		for k, v := range resolved {
+			h.params[k] = v
+		}
+	}
+	if h.isRaw {
+		h.params.AddValues(r.URL.Query())
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		defer r.Body.Close()
+		handler.logBody(id, "request", data)
+		h.raw = data
+		h.received = int64(len(data))
+	} else if h.isJson {
 		u, err := url.ParseRequestURI(r.RequestURI)
 		if err != nil {
 			return nil, err
 		}
 		h.params.AddValues(u.Query())
-		data, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return nil, err
+		var data []byte
+		if handler.parseGetBody || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			if data, err = ioutil.ReadAll(r.Body); err != nil {
+				return nil, err
+			}
 		}
 		defer r.Body.Close()
-		if err := h.params.AddJSON(data); err != nil {
-			return nil, err
+		handler.logBody(id, "request", data)
+		// GET requests often come with a JSON content type but no body.
+		if len(bytes.TrimSpace(data)) != 0 {
+			if data, err = handler.decrypt(data); err != nil {
+				return nil, badRequest(err)
+			}
+			h.received = int64(len(data))
+			if err := handler.validate(name, data); err != nil {
+				var e *InvalidPayload
+				if errors.As(err, &e) {
+					e.Id = id
+				}
+				return nil, badRequest(err)
+			}
+			// The body is checked now, but only decoded once needed,
+			// unless the limits need to see all of it.
+			var obj struct{}
+			if err := json.Unmarshal(data, &obj); err != nil {
+				return nil, badRequest(err)
+			}
+			h.pending = data
+			if handler.jsonOpts.MaxParams > 0 || handler.jsonOpts.MaxDepth > 0 {
+				if err := h.loadParams(); err != nil {
+					return nil, err
+				}
+			}
 		}
 	} else {
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
 		if err := r.ParseForm(); err != nil {
-			return nil, err
+			return nil, badRequest(err)
 		}
+		h.received = body.n
 		h.params.AddValues(r.Form)
+		handler.logBody(id, "request", []byte(r.PostForm.Encode()))
+	}
+	if !merged {
+		if h.pending != nil {
+			h.overrides = resolved
+		} else {
+			for k, v := range resolved {
+				h.params[k] = v
+			}
+		}
 	}
 	return h, nil
 }
 
-func (h *hook) exec() (int, []byte) {
-	f := func() (int, []byte, error) {
-		ipt := h.handler.iptPool.Get()
-		defer h.handler.iptPool.Put(ipt)
-		var buf bytes.Buffer
-		var status int
-		ipt.Bind("Id", h.id)
-		ipt.Bind("WriteBody", func(str string) error {
-			if !h.isSync {
-				return ErrSyncNeeded
-			}
-			_, err := buf.WriteString(str)
+// loadParams decodes the pending JSON body into the params. Scripts do
+// so when they first read ghoko.Params. Go code reading the params has
+// to call it first.
+func (h *hook) loadParams() error {
+	if h.pending == nil {
+		return h.paramsErr
+	}
+	data := h.pending
+	h.pending = nil
+	if err := h.params.AddJSONOptions(data, h.handler.jsonOpts); err != nil {
+		h.paramsErr = badRequest(err)
+		return h.paramsErr
+	}
+	for k, v := range h.overrides {
+		h.params[k] = v
+	}
+	h.overrides = nil
+	return nil
+}
+
+func (h *hook) bind(ipt iptpool.ScriptIpt) {
+	h.scratch = make(luar.Map)
+	ipt.Bind("Ctx", h.scratch)
+	ipt.Bind("Id", h.id)
+	ipt.Bind("ResultId", h.resultKey())
+	h.bindLog(ipt)
+	ipt.Bind("RawBody", string(h.raw))
+	ipt.Bind("Request", luar.Map{
+		"Script":      h.name,
+		"File":        h.handler.scriptFile(h.name),
+		"Method":      h.r.Method,
+		"Path":        h.r.URL.Path,
+		"ContentType": h.r.Header.Get("Content-Type"),
+		"Target":      h.target,
+	})
+	ipt.Bind("ClientIP", h.handler.ClientIP(h.r))
+	ipt.Bind("WriteBody", h.writeBody)
+	ipt.Bind("WriteHeader", func(s int) error {
+		if !h.isSync {
+			return ErrSyncNeeded
+		}
+		if h.streamed {
+			return ErrHeaderSent
+		}
+		if h.written > 0 {
+			return ErrBodyWritten
+		}
+		if err := h.allowStatus(s); err != nil {
 			return err
-		})
-		ipt.Bind("WriteHeader", func(s int) error {
-			if !h.isSync {
-				return ErrSyncNeeded
+		}
+		h.status = s
+		return nil
+	})
+	ipt.Bind("Status", func() int {
+		return h.status
+	})
+	ipt.Bind("Get", func(uri string) ([]byte, error) {
+		ctx, cancel := h.outboundContext()
+		defer cancel()
+		return h.handler.get(ctx, uri)
+	})
+	ipt.Bind("PostJSON", func(uri string, params Params) ([]byte, error) {
+		ctx, cancel := h.outboundContext()
+		defer cancel()
+		return h.handler.postJson(ctx, uri, params)
+	})
+	ipt.Bind("Post", func(uri string, params Params) ([]byte, error) {
+		ctx, cancel := h.outboundContext()
+		defer cancel()
+		return h.handler.post(ctx, uri, params)
+	})
+	ipt.Bind("Http", h.httpBinding())
+	ipt.Bind("Lock", h.lockBinding())
+	ipt.Bind("Emit", h.emit)
+	ipt.Bind("SetParam", func(name string, v interface{}) {
+		h.loadParams()
+		h.params[name] = v
+	})
+	ipt.Bind("SetContentType", func(ct string) error {
+		return h.setHeader("Content-Type", ct)
+	})
+	ipt.Bind("SetHeader", h.setHeader)
+	ipt.Bind("Redirect", h.redirect)
+	ipt.Bind("SendFile", h.sendFile)
+	ipt.Bind("NoContent", h.noContent)
+	ipt.Bind("SetOutcome", h.setOutcome)
+	ipt.Bind("Timer", h.timerBinding())
+	ipt.Bind("Aborted", h.aborted)
+	ipt.Bind("Context", luar.Map{
+		"Err": func() string {
+			if err := h.ctx.Err(); err != nil {
+				return err.Error()
 			}
-			status = s
-			return nil
-		})
+			return ""
+		},
+	})
+	ipt.Bind("Fail", func(status int, msg string) error {
+		if status < 400 || status > 599 {
+			status = http.StatusInternalServerError
+		}
+		// The script still fails, with 500, if status is not allowed.
+		err := h.allowStatus(status)
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		h.failure = &HttpError{status, msg}
+		return err
+	})
+	ipt.Bind("Coalesce", h.coalesce)
+	ipt.Bind("Enqueue", h.handler.enqueue)
+	ipt.Bind("Db", h.dbBinding())
+	ipt.Bind("Config", h.handler.configBinding())
+	wd, wdErr := h.handler.scriptWorkDir(h.name)
+	ipt.Bind("WorkDir", string(wd))
+	ipt.Bind("Exec", func(name string, args ...string) (string, error) {
+		if wdErr != nil {
+			return "", wdErr
+		}
+		return wd.exec(name, args...)
+	})
+	ipt.Bind("ReadFile", func(p string) (string, error) {
+		if wdErr != nil {
+			return "", wdErr
+		}
+		return wd.readFile(p)
+	})
+	ipt.Bind("WriteFile", func(p, data string) error {
+		if wdErr != nil {
+			return wdErr
+		}
+		return wd.writeFile(p, data)
+	})
+	if h.bindExtra != nil {
+		h.bindExtra(ipt)
+	}
+}
+
+func (h *hook) run(ipt *pooledIpt) (int, []byte, error) {
+	if d, ok := ipt.ScriptIpt.(deadliner); ok {
+		timeout := h.timeout
+		if timeout == 0 {
+			timeout = h.handler.scriptTimeout(h.name)
+		}
+		if timeout > 0 {
+			h.deadline = time.Now().Add(timeout)
+			d.SetDeadline(h.deadline)
+			defer d.SetDeadline(time.Time{})
+		}
+	}
+	if m, ok := ipt.ScriptIpt.(memoryLimiter); ok {
+		m.SetMemoryLimit(h.handler.memoryLimit)
+	}
+	if status, err := h.transform(ipt); err != nil {
+		return status, nil, err
+	}
+	if err := h.execScript(ipt.ScriptIpt); err != nil {
+		if h.paramsErr != nil {
+			return StatusCode(h.paramsErr), nil, h.paramsErr
+		}
+		return http.StatusInternalServerError, nil, err
+	}
+	if h.failure != nil {
+		return h.failure.status, nil, h.failure
+	}
+	return h.status, h.body.Bytes(), nil
+}
+
+// lazyExecer is implemented by interpreters able to decode the params
+// when a script first reads them.
+type lazyExecer interface {
+	ExecLazy(name string, load func() Params) error
+}
 
-		if err := ipt.Exec(h.name, h.params); err != nil {
-			if !h.isSync {
-				writeAndLogError(nil, h.r, err)
+// execScript runs the script of the hook, decoding a pending body only
+// if the script reads ghoko.Params.
+func (h *hook) execScript(ipt iptpool.ScriptIpt) error {
+	if l, ok := ipt.(lazyExecer); ok && h.pending != nil {
+		return l.ExecLazy(h.name, func() Params {
+			if h.loadParams() != nil {
+				return nil
 			}
-			return http.StatusInternalServerError, nil, err
+			return h.params
+		})
+	}
+	if err := h.loadParams(); err != nil {
+		return err
+	}
+	return ipt.Exec(h.name, h.params)
+}
+
+// runPooled runs the script on an interpreter from the pool.
+func (h *hook) runPooled() (int, []byte, error) {
+	ipt, err := h.handler.getIpt()
+	if err != nil {
+		return http.StatusServiceUnavailable, nil, err
+	}
+	defer h.handler.putIpt(ipt)
+	if i, ok := ipt.ScriptIpt.(identifier); ok {
+		h.worker = i.WorkerId()
+	}
+	h.bind(ipt)
+	return h.run(ipt)
+}
+
+// tags are appended to the access log line of the hook.
+func (h *hook) tags() string {
+	var tags []string
+	if h.outcome != "" {
+		tags = append(tags, "outcome="+h.outcome)
+	}
+	if h.worker != 0 {
+		tags = append(tags, "worker="+strconv.FormatInt(h.worker, 10))
+	}
+	tags = append(tags, "in="+strconv.FormatInt(h.received, 10), "out="+strconv.FormatInt(h.written, 10))
+	return strings.Join(tags, " ")
+}
+
+// execute runs the script on a pooled interpreter. Errors of async
+// hooks are logged, since there is no client to tell.
+func (h *hook) execute() (int, []byte, error) {
+	start := time.Now()
+	status, data, err := h.settle(h.runPooled())
+	h.releaseLocks()
+	if d := time.Since(start); h.handler.slowThreshold > 0 && d > h.handler.slowThreshold {
+		log.Warningf("%s Slow script %q: %s", h.id, h.name, d)
+	}
+	if h.outcome != "" {
+		h.handler.outcomes.add(h.outcome)
+	}
+	h.handler.events.publish(event{kind: "execution", Id: h.id, Name: h.name, Status: status, Outcome: h.outcome, Time: time.Now()})
+	h.handler.sizes.observe("request", float64(h.received))
+	h.handler.sizes.observe("response", float64(h.written))
+	h.handler.storeResult(h, status, data, err)
+	if err != nil && h.aborted() {
+		log.Warningf("%s client disconnected: %s", h.id, err)
+		return statusClientClosed, nil, err
+	}
+	if err != nil {
+		atomic.AddInt64(&h.handler.stats.errors, 1)
+		if !h.isSync {
+			h.handler.writeAndLogError(nil, h.r, err)
 		}
-		return http.StatusOK, buf.Bytes(), nil
+	} else if !h.isSync && h.outcome != "" && h.accessLogged(status) {
+		h.handler.writeAndLogTags(nil, h.r, status, nil, h.tags())
+	}
+	return status, data, err
+}
+
+// done gives back the concurrency slot of the request, if any.
+func (h *hook) done() {
+	if h.release != nil {
+		h.release()
 	}
+}
 
+func (h *hook) exec() (int, []byte) {
 	if h.isSync {
-		h.w.Header().Set("Ghoko-Id", h.id)
-		status, data, err := f()
+		defer h.done()
+		h.handler.setId(h.w, h.id)
+		h.setResultId()
+		status, data, err := h.execute()
+		if err != nil && h.aborted() {
+			return status, nil
+		}
+		if h.streamed {
+			if err != nil {
+				log.Errorf("%s failed after streaming: %s", h.id, err)
+			}
+			return status, nil
+		}
+		// Nothing was sent yet, so a failed script still gets its
+		// error status, even if it asked for a file.
 		if err != nil {
-			return http.StatusInternalServerError, []byte(err.Error())
+			return StatusCode(err), []byte(err.Error())
+		}
+		if h.download != "" {
+			if err := h.writeFile(); err != nil && !h.streamed {
+				return http.StatusInternalServerError, []byte(err.Error())
+			} else if err != nil {
+				log.Errorf("%s send file %q: %s", h.id, h.download, err)
+			}
+			return status, nil
+		}
+		if len(data) == 0 && status == http.StatusOK && !h.redirected && h.handler.lookup(h.name).noContent {
+			status, h.empty = http.StatusNoContent, true
 		}
+		if h.empty {
+			return status, nil
+		}
+		if len(data) == 0 && !h.redirected && h.handler.defaultBody != "" {
+			data = h.handler.defaultBodyFor(h.id)
+			if h.w.Header().Get("Content-Type") == "" && h.handler.defaultType != "" {
+				h.w.Header().Set("Content-Type", h.handler.defaultType)
+			}
+		}
+		h.w.Header().Set("Content-Length", strconv.Itoa(len(data)))
 		return status, data
 	}
-	go f()
+	h.handler.setId(h.w, h.id)
+	h.setResultId()
+	if h.handler.publisher != nil {
+		defer h.done()
+		if err := h.publish(); err != nil {
+			return http.StatusServiceUnavailable, []byte(err.Error())
+		}
+		return http.StatusOK, h.data(h.id)
+	}
+	err := h.handler.async(h.priority(), func() {
+		defer h.done()
+		h.execute()
+	})
+	if err != nil {
+		h.done()
+		return StatusCode(err), []byte(err.Error())
+	}
 	return http.StatusOK, h.data(h.id)
 }
 
@@ -0,0 +1,72 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// failIpt runs a script writing a body, then calling ghoko.Fail.
+type failIpt struct {
+	status   int
+	bindings map[string]interface{}
+}
+
+func (ipt *failIpt) Init(string) error { return nil }
+func (ipt *failIpt) Final() error      { return nil }
+
+func (ipt *failIpt) Bind(name string, item interface{}) error {
+	ipt.bindings[name] = item
+	return nil
+}
+
+func (ipt *failIpt) Exec(string, interface{}) error {
+	if err := ipt.bindings["WriteBody"].(func(string) error)("partial"); err != nil {
+		return err
+	}
+	ipt.bindings["Fail"].(func(int, string) error)(ipt.status, "ref is required")
+	return nil
+}
+
+// newFailHook makes a sync hook whose script calls ghoko.Fail(status).
+func newFailHook(t *testing.T, status int) (*hook, *httptest.ResponseRecorder) {
+	h := New(".", "", "/")
+	h.gen.put(&failIpt{status, make(map[string]interface{})}, 0)
+	r := httptest.NewRequest("POST", "/deploy", nil)
+	r.Header.Set("Ghoko-Sync", "true")
+	w := httptest.NewRecorder()
+	hk, err := newHook(h, w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hk, w
+}
+
+func TestFail(t *testing.T) {
+	for _, c := range []struct {
+		status, want int
+	}{
+		{422, 422},
+		{599, 599},
+		// Outside 400-599 it is turned into 500.
+		{302, 500},
+		{600, 500},
+	} {
+		hk, w := newFailHook(t, c.status)
+		status, data := hk.exec()
+		if status != c.want {
+			t.Errorf("Fail(%d): status = %d, want %d", c.status, status, c.want)
+		}
+		// What was written before is discarded.
+		if string(data) != "ref is required" {
+			t.Errorf("Fail(%d): body = %q, want %q", c.status, data, "ref is required")
+		}
+		if got := w.Header().Get(defaultIdHeader); got == "" || got != hk.id {
+			t.Errorf("Fail(%d): id = %q, want %q", c.status, got, hk.id)
+		}
+	}
+}
@@ -7,12 +7,21 @@ package ghoko
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io/fs"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mikespook/golib/idgen"
 	"github.com/mikespook/golib/iptpool"
@@ -20,48 +29,329 @@ import (
 )
 
 type Handler struct {
-	scriptPath string
-	secret     string
-	idgen      idgen.IdGen
-	iptPool    *iptpool.IptPool
-	rootUrl    string
+	stats             stats // first for 64-bit atomic alignment
+	maintenance       int32
+	scriptPath        string
+	secret            string
+	idgen             idgen.IdGen
+	mu                sync.RWMutex
+	gen               *generation
+	rootUrl           string
+	jsonOpts          JSONOptions
+	startTime         time.Time
+	routes            map[string]http.HandlerFunc
+	public            map[string]http.HandlerFunc
+	statusPath        string
+	workDir           string
+	location          *time.Location
+	outbound          *hostGuard
+	coalescer         *coalescer
+	bodyLog           bool
+	bodyLogMax        int
+	timeout           time.Duration
+	scripts           map[string]*scriptOptions
+	trustedProxies    []*net.IPNet
+	defaultBody       string
+	defaultType       string
+	resetGlobals      bool
+	sandbox           []string
+	access            *accessLog
+	db                *sql.DB
+	dbTimeout         time.Duration
+	shutdownScript    string
+	startupScript     string
+	maxBody           int64
+	contentTypes      []string
+	initPolicy        InitPolicy
+	payload           cipher.AEAD
+	slashPolicy       SlashPolicy
+	batchPath         string
+	maxBatch          int
+	cache             *cache
+	expectStatus      int
+	aliases           map[string]alias
+	profiles          map[string]Profile
+	profile           string
+	bindings          map[string]interface{}
+	inFlight          *inFlight
+	maxConcurrency    int64
+	maxPerIP          int
+	outcomes          *outcomes
+	scriptFS          fs.FS
+	workers           *workers
+	maxClientPriority int
+	timers            *timers
+	allowedScripts    map[string]bool
+	results           *cache
+	resultTTL         time.Duration
+	dbPolicy          BackendPolicy
+	dbBackend         backend
+	maxResponse       int64
+	browserPretty     bool
+	stopReaper        chan struct{}
+	minPool           int32
+	signSecrets       []string
+	signTolerance     time.Duration
+	secretLocs        SecretLocations
+	downloadDir       string
+	configPath        string
+	configured        map[string]ScriptConfig
+	slowThreshold     time.Duration
+	closed            bool
+	rawHandler        string
+	grace             map[*HttpError]GraceResponse
+	remoteSecret      string
+	remoteTimestamp   bool
+	outboundSlots     chan struct{}
+	transforms        []Transform
+	recorder          *recorder
+	settings          map[string]interface{}
+	maxExecs          int32
+	sizes             *timers
+	resolver          NameResolver
+	publisher         Publisher
+	logLevel          LogLevel
+	warmupScripts     []string
+	locker            Locker
+	idHeader          string
+	memoryLimit       int64
+	events            *broker
+	signCanonical     bool
+	allowedStatuses   map[int]bool
+	maxWarmup         int
+	maxQueued         int
+	configAliases     map[string]bool
+	parseGetBody      bool
+	client            *http.Client
+	lockerPolicy      BackendPolicy
+	lockerBackend     backend
+	httpBackends      map[string]*backend
 }
 
 func New(scriptPath, secret, rootUrl string) (h *Handler) {
 	h = &Handler{
-		scriptPath: scriptPath,
-		secret:     secret,
-		idgen:      idgen.NewObjectId(),
-		iptPool:    iptpool.NewIptPool(NewLuaIpt),
-		rootUrl:    path.Clean(path.Join("/", rootUrl, "/")),
-	}
-	h.iptPool.OnCreate = func(ipt iptpool.ScriptIpt) error {
-		ipt.Init(h.scriptPath)
-		ipt.Bind("Call", h.call)
-		ipt.Bind("Get", h.get)
-		ipt.Bind("PostJSON", h.postJson)
-		ipt.Bind("Post", h.post)
-		ipt.Bind("Secret", h.secret)
-		return nil
+		scriptPath:    scriptPath,
+		secret:        secret,
+		idgen:         idgen.NewObjectId(),
+		startTime:     time.Now(),
+		routes:        make(map[string]http.HandlerFunc),
+		public:        make(map[string]http.HandlerFunc),
+		location:      time.Local,
+		outbound:      newHostGuard(),
+		dbBackend:     backend{name: "Database"},
+		lockerBackend: backend{name: "Lock store"},
+		coalescer:     newCoalescer(),
+		cache:         newCache(defaultCacheSize),
+		locker:        NewMemLocker(),
+		client:        &http.Client{Timeout: defaultOutboundTimeout},
+		events:        newBroker(),
+		scripts:       make(map[string]*scriptOptions),
+		aliases:       make(map[string]alias),
+		secretLocs:    SecretLocations{Query: "_secret"},
+		profiles:      make(map[string]Profile),
+		bindings:      make(map[string]interface{}),
+		inFlight:      &inFlight{perIP: make(map[string]int)},
+		outcomes:      &outcomes{counts: make(map[string]int64)},
+		timers:        &timers{sections: make(map[string]*timerStatus)},
+		sizes:         &timers{buckets: sizeBuckets, sections: make(map[string]*timerStatus)},
+		grace: map[*HttpError]GraceResponse{
+			ErrMaintenance: {RetryAfter: maintenanceRetryAfter * time.Second},
+		},
 	}
+	h.SetBasePath(rootUrl)
+	h.SetStatusPath("/status")
+	h.routes["/admin/maintenance"] = h.serveMaintenance
+	h.routes["/admin/warmup"] = h.serveWarmup
+	h.routes["/events"] = h.serveEvents
+	h.public["/version"] = h.serveVersion
+	h.gen = h.newGeneration()
 	return h
 }
 
-func writeAndLogError(w http.ResponseWriter, r *http.Request, err error) {
-	if e, ok := err.(*HttpError); ok {
-		writeAndLog(w, r, e.status, []byte(err.Error()))
+func (h *Handler) onCreate(ipt iptpool.ScriptIpt) error {
+	worker := atomic.AddInt64(&h.stats.created, 1)
+	if i, ok := ipt.(identifier); ok {
+		i.SetWorkerId(worker)
+	}
+	if err := h.checkScripts(); err != nil {
+		return err
+	}
+	if err := ipt.Init(h.scriptPath); err != nil {
+		return err
+	}
+	if l, ok := ipt.(fsLoader); ok && h.scriptFS != nil {
+		l.SetFS(h.scriptFS)
+	}
+	ipt.Bind("Call", h.call)
+	ipt.Bind("Secret", h.currentSecret())
+	ipt.Bind("Server", h.serverBinding(worker))
+	ipt.Bind("Env", h.envBinding())
+	ipt.Bind("Uptime", h.uptime)
+	ipt.Bind("Time", h.timeBinding())
+	ipt.Bind("Net", netBinding())
+	ipt.Bind("Cache", h.cache.binding())
+	ipt.Bind("Result", h.resultBinding())
+	ipt.Bind("Len", paramLen)
+	ipt.Bind("Slice", paramSlice)
+	ipt.Bind("Path", paramPath)
+	ipt.Bind("ToQuery", toQuery)
+	ipt.Bind("ToJSON", toJSON)
+	ipt.Bind("Json", jsonBinding())
+	h.bindCustom(ipt)
+	if s, ok := ipt.(sandboxer); ok && h.sandbox != nil {
+		if err := s.Sandbox(h.sandbox); err != nil {
+			return err
+		}
+	}
+	if r, ok := ipt.(resetter); ok && h.resetGlobals {
+		return r.Snapshot()
+	}
+	return nil
+}
+
+// SetBasePath mounts the handler under prefix. The prefix is stripped
+// before resolving the script name, and requests outside it are
+// rejected with 404.
+func (h *Handler) SetBasePath(prefix string) {
+	h.rootUrl = path.Clean(path.Join("/", prefix, "/"))
+}
+
+// SetParamsLimit caps the number of params and the nesting depth
+// accepted from a JSON body. Requests exceeding either get 400.
+// Zero disables the corresponding limit.
+func (h *Handler) SetParamsLimit(maxParams, maxDepth int) {
+	h.jsonOpts.MaxParams = maxParams
+	h.jsonOpts.MaxDepth = maxDepth
+}
+
+// SetUseNumber makes JSON numbers reach scripts as their exact literal
+// strings instead of float64.
+func (h *Handler) SetUseNumber(useNumber bool) {
+	h.jsonOpts.UseNumber = useNumber
+}
+
+// SetDefaultBody sets the body returned by sync scripts which succeed
+// without writing anything. `{id}` in body is replaced by the request id.
+// contentType is used unless the script set one. An empty body keeps
+// the response empty, which is the default.
+func (h *Handler) SetDefaultBody(body, contentType string) {
+	h.defaultBody = body
+	h.defaultType = contentType
+}
+
+func (h *Handler) defaultBodyFor(id string) []byte {
+	return []byte(strings.Replace(h.defaultBody, "{id}", id, -1))
+}
+
+// SetParseGetBody makes JSON bodies of GET requests reach scripts too.
+// It is off by default, so GET requests only get the params of the URL.
+func (h *Handler) SetParseGetBody(parse bool) {
+	h.parseGetBody = parse
+}
+
+// SetDeepMerge makes nested JSON objects merge recursively into params
+// already present, instead of replacing them.
+func (h *Handler) SetDeepMerge(deepMerge bool) {
+	h.jsonOpts.DeepMerge = deepMerge
+}
+
+// scriptName strips the base path from p and returns the remaining
+// script name. It reports false if p is not under the base path.
+func (h *Handler) scriptName(p string) (string, bool) {
+	name, ok := h.rawScriptName(p)
+	if !ok {
+		return "", false
+	}
+	return h.resolvedName(name)
+}
+
+// resolvedName applies aliases and allowed scripts to name.
+func (h *Handler) resolvedName(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	if a, ok := h.alias(name); ok {
+		name = a.name
+	}
+	if !h.allowed(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// route returns the endpoint of routes at p, which is resolved against
+// the base path like a script name is.
+func (h *Handler) route(routes map[string]http.HandlerFunc, p string) (http.HandlerFunc, bool) {
+	name, ok := h.rawScriptName(p)
+	if !ok {
+		return nil, false
+	}
+	route, ok := routes["/"+name]
+	return route, ok
+}
+
+// rawScriptName is scriptName without resolving aliases.
+func (h *Handler) rawScriptName(p string) (string, bool) {
+	p = cleanPath(p)
+	if h.rootUrl != "/" {
+		if p != h.rootUrl && !strings.HasPrefix(p, h.rootUrl+"/") {
+			return "", false
+		}
+		p = strings.TrimPrefix(p, h.rootUrl)
+	}
+	name := strings.TrimPrefix(p, "/")
+	if name == "" {
+		return "", false
+	}
+	return name, true
+}
+
+func (h *Handler) writeAndLogError(w http.ResponseWriter, r *http.Request, err error) {
+	var ip *InvalidPayload
+	if errors.As(err, &ip) {
+		data, _ := json.Marshal(ip)
+		if w != nil {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		h.writeAndLog(w, r, http.StatusBadRequest, data)
+		return
+	}
+	var he *HttpError
+	if errors.As(err, &he) {
+		if h.writeGrace(w, r, he) {
+			return
+		}
+		h.writeAndLog(w, r, he.status, []byte(err.Error()))
 		return
 	}
-	writeAndLog(w, r, http.StatusInternalServerError, []byte(err.Error()))
+	h.writeAndLog(w, r, http.StatusInternalServerError, []byte(err.Error()))
 }
 
-func writeAndLog(w http.ResponseWriter, r *http.Request, status int, data []byte) {
-	log.Messagef("%s %s %q %d %q", r.RemoteAddr, r.Method, r.URL.String(), status, data)
+func (h *Handler) writeAndLog(w http.ResponseWriter, r *http.Request, status int, data []byte) {
+	h.writeAndLogTags(w, r, status, data, "")
+}
+
+// writeAndLogTags is writeAndLog with the tags of a hook, see hook.tags.
+func (h *Handler) writeAndLogTags(w http.ResponseWriter, r *http.Request, status int, data []byte, tags string) {
+	if tags != "" {
+		h.accessf("%s %s %q %d %q %s", h.ClientIP(r), r.Method, h.redact(r.URL.String()), status, data, tags)
+	} else {
+		h.accessf("%s %s %q %d %q", h.ClientIP(r), r.Method, h.redact(r.URL.String()), status, data)
+	}
+	h.write(w, r, status, data)
+}
+
+// write writes the response without access logging it.
+func (h *Handler) write(w http.ResponseWriter, r *http.Request, status int, data []byte) {
 	if w != nil {
+		data = h.prettify(w, r, data)
 		w.WriteHeader(status)
-		if data != nil {
-			if _, err := w.Write(data); err != nil {
-				log.Errorf("%s %s %q %d %q", r.RemoteAddr, r.Method, r.URL.String(), status, err)
+		// HEAD gets the headers, Content-Length included, but no body.
+		if data != nil && r.Method != http.MethodHead {
+			if _, err := w.Write(data); err != nil && (r.Context().Err() != nil || isDisconnect(err)) {
+				log.Warningf("%s %s %q %d client disconnected: %s", h.ClientIP(r), r.Method, h.redact(r.URL.String()), status, err)
+			} else if err != nil {
+				log.Errorf("%s %s %q %d %q", h.ClientIP(r), r.Method, h.redact(r.URL.String()), status, err)
 			}
 		}
 	}
@@ -70,96 +360,171 @@ func writeAndLog(w http.ResponseWriter, r *http.Request, status int, data []byte
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	u, err := url.ParseRequestURI(r.RequestURI)
 	if err != nil {
-		writeAndLogError(w, r, err)
+		h.writeAndLogError(w, r, err)
+		return
+	}
+	if route, ok := h.route(h.public, r.URL.Path); ok {
+		route(w, r)
+		return
+	}
+	authorized := h.authorized(r, u)
+	if !authorized && h.secretLocs.Body == "" {
+		h.writeAndLogError(w, r, ErrForbidden)
 		return
 	}
-	if u.Query().Get("_secret") != h.secret {
-		writeAndLogError(w, r, ErrForbidden)
+	if !h.normalize(w, r) {
 		return
 	}
+	if route, ok := h.route(h.routes, r.URL.Path); ok {
+		if !authorized {
+			h.writeAndLogError(w, r, ErrForbidden)
+			return
+		}
+		route(w, r)
+		return
+	}
+	if h.InMaintenance() {
+		h.writeAndLogError(w, r, ErrMaintenance)
+		return
+	}
+	if h.redirectAlias(w, r) {
+		return
+	}
+	if !authorized && !h.bodySecret(r) {
+		h.writeAndLogError(w, r, ErrForbidden)
+		return
+	}
+	atomic.AddInt64(&h.stats.requests, 1)
+	release, err := h.acquire(h.ClientIP(r))
+	if err != nil {
+		h.writeAndLogError(w, r, err)
+		return
+	}
+	body := h.capture(r)
 	hook, err := newHook(h, w, r)
 	if err != nil {
-		writeAndLogError(w, r, err)
+		release()
+		h.writeAndLogError(w, r, err)
 		return
 	}
+	hook.stripSecret()
+	h.record(hook, body)
+	hook.release = release
 	status, data := hook.exec()
-	writeAndLog(w, r, status, data)
+	if hook.streamed {
+		w = nil
+	}
+	if !hook.accessLogged(status) {
+		h.write(w, r, status, data)
+		return
+	}
+	h.writeAndLogTags(w, r, status, data, hook.tags())
 }
 
-func (h *Handler) post(uri string, params Params) ([]byte, error) {
+func (h *Handler) post(ctx context.Context, uri string, params Params) ([]byte, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
 	q := u.Query()
-	q.Add("secret", h.secret)
-	resp, err := http.PostForm(u.String(), params.Values())
+	q.Add("secret", h.currentSecret())
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), strings.NewReader(params.Values().Encode()))
 	if err != nil {
 		return nil, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(string(body))
-	}
-	return body, nil
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return h.fetch(req)
 }
 
-func (h *Handler) postJson(uri string, params Params) ([]byte, error) {
+func (h *Handler) postJson(ctx context.Context, uri string, params Params) ([]byte, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
 	q := u.Query()
-	q.Add("secret", h.secret)
+	q.Add("secret", h.currentSecret())
 	j, err := json.Marshal(params)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.Post(u.String(), "application/json", bytes.NewBuffer(j))
-	if err != nil {
-		return nil, err
-	}
-	body, err := ioutil.ReadAll(resp.Body)
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewBuffer(j))
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(string(body))
-	}
-	return body, nil
+	req.Header.Set("Content-Type", "application/json")
+	return h.fetch(req)
 }
 
-func (h *Handler) get(uri string) ([]byte, error) {
+func (h *Handler) get(ctx context.Context, uri string) ([]byte, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
 	q := u.Query()
-	q.Add("secret", h.secret)
-	resp, err := http.Get(u.String())
+	q.Add("secret", h.currentSecret())
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	return h.fetch(req)
+}
+
+// fetch sends req through the outbound guard and returns the body of
+// a 200 response.
+func (h *Handler) fetch(req *http.Request) ([]byte, error) {
+	resp, body, err := h.send(req)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(string(body))
+		return nil, errors.New(string(body))
 	}
 	return body, nil
 }
 
+// send sends req through the outbound guard and returns the response
+// along with its body, whatever the status is.
+func (h *Handler) send(req *http.Request) (*http.Response, []byte, error) {
+	if h.remoteSecret != "" {
+		if err := h.sign(req); err != nil {
+			return nil, nil, err
+		}
+	}
+	if h.outboundSlots != nil {
+		select {
+		case h.outboundSlots <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, nil, req.Context().Err()
+		}
+		defer func() { <-h.outboundSlots }()
+	}
+	host := req.URL.Host
+	if err := h.httpBackend(host); err != nil {
+		return nil, nil, err
+	}
+	if err := h.outbound.allow(host); err != nil {
+		return nil, nil, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		h.outbound.done(host, false)
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	h.outbound.done(host, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
 func (h *Handler) call(id, name string, params Params) error {
-	ipt := h.iptPool.Get()
-	defer h.iptPool.Put(ipt)
+	ipt, err := h.getIpt()
+	if err != nil {
+		return err
+	}
+	defer h.putIpt(ipt)
 	ipt.Bind("Id", id)
 	return ipt.Exec(name, params)
 }
@@ -0,0 +1,57 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import "net/http"
+
+const (
+	defaultIdHeader = "Ghoko-Id"
+	maxIdLength     = 128
+)
+
+// SetIdHeader reuses the id in header name of requests, e.g. the
+// X-Request-Id of a proxy, instead of Ghoko-Id. Requests without one get
+// a new id. Responses carry the id in both headers.
+func (h *Handler) SetIdHeader(name string) {
+	h.idHeader = http.CanonicalHeaderKey(name)
+}
+
+func (h *Handler) idHeaderName() string {
+	if h.idHeader == "" {
+		return defaultIdHeader
+	}
+	return h.idHeader
+}
+
+// requestId returns the id passed with r, or a new one. Ids too long or
+// with characters other than printable ASCII are replaced, so they can
+// not forge log lines.
+func (h *Handler) requestId(r *http.Request) string {
+	if id := r.Header.Get(h.idHeaderName()); validId(id) {
+		return id
+	}
+	return h.idgen.Id().(string)
+}
+
+func validId(id string) bool {
+	if id == "" || len(id) > maxIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// setId sets the id headers of the response.
+func (h *Handler) setId(w http.ResponseWriter, id string) {
+	w.Header().Set(defaultIdHeader, id)
+	if name := h.idHeaderName(); name != defaultIdHeader {
+		w.Header().Set(name, id)
+	}
+}
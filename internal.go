@@ -0,0 +1,96 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// headerWriter is the http.ResponseWriter of executions without a
+// client. It keeps headers and discards the body.
+type headerWriter struct {
+	header http.Header
+}
+
+func (w *headerWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *headerWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *headerWriter) WriteHeader(int) {}
+
+// internalHook returns a sync hook running the script name outside of
+// any HTTP request, e.g. on startup or shutdown.
+func (h *Handler) internalHook(name string, params Params) *hook {
+	r, _ := http.NewRequest("POST", path.Join(h.rootUrl, name), nil)
+	id := h.idgen.Id().(string)
+	return &hook{
+		ctx:      context.Background(),
+		id:       id,
+		resultId: id,
+		isSync:   true,
+		w:        &headerWriter{make(http.Header)},
+		r:        r,
+		params:   params,
+		name:     name,
+		handler:  h,
+		status:   http.StatusOK,
+	}
+}
+
+// runInternal runs the script name, giving up after timeout. Zero uses
+// the script timeout instead.
+func (h *Handler) runInternal(name string, timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		timeout = h.scriptTimeout(name)
+	}
+	hk := h.internalHook(name, make(Params))
+	hk.timeout = timeout
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := hk.execute()
+		done <- err
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case err := <-done:
+		return hk.id, err
+	case <-expired:
+		return hk.id, ErrTimeout
+	}
+}
+
+// Execute runs the script name with params without going through HTTP,
+// on the same pool and bindings as requests. Async executions return
+// right away with their id only. It is meant for embedding ghoko, and
+// for testing and benchmarking scripts.
+func (h *Handler) Execute(name string, params Params, sync bool) (string, []byte, error) {
+	name, ok := h.scriptName(path.Join(h.rootUrl, name))
+	if !ok {
+		return "", nil, ErrNotFound
+	}
+	if params == nil {
+		params = make(Params)
+	}
+	if !sync {
+		id, err := h.enqueue(name, params)
+		return id, nil, err
+	}
+	atomic.AddInt64(&h.stats.requests, 1)
+	hk := h.internalHook(name, params)
+	_, data, err := hk.execute()
+	return hk.id, data, err
+}
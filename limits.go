@@ -0,0 +1,173 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mikespook/golib/log"
+)
+
+// SetMaxBodySize rejects request bodies larger than n bytes with 413.
+// Zero means no limit.
+func (h *Handler) SetMaxBodySize(n int64) {
+	h.maxBody = n
+}
+
+// SetMaxResponseSize caps the bytes a request may write with WriteBody
+// at n. The write exceeding it fails, and so does the request, with 500.
+// Zero means no limit.
+func (h *Handler) SetMaxResponseSize(n int64) {
+	h.maxResponse = n
+}
+
+// SetContentTypes rejects requests whose body is not one of the media
+// types with 415, e.g. "application/json". No types allows all.
+func (h *Handler) SetContentTypes(types ...string) {
+	h.contentTypes = types
+}
+
+// SetBodyLimitsFor overrides the body size limit and the allowed content
+// types for the script name. Zero and no types keep the defaults.
+func (h *Handler) SetBodyLimitsFor(name string, maxBody int64, types ...string) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.maxBody = maxBody
+		opts.contentTypes = types
+	})
+}
+
+// checkBody enforces the body policy of the script name on r, and
+// limits the body of r to the allowed size.
+func (h *Handler) checkBody(name string, r *http.Request) error {
+	opts := h.lookup(name)
+	maxBody, types := h.maxBody, h.contentTypes
+	if opts.maxBody != 0 {
+		maxBody = opts.maxBody
+	}
+	if opts.contentTypes != nil {
+		types = opts.contentTypes
+	}
+	if len(types) > 0 && r.ContentLength != 0 && !allowedType(r.Header.Get("Content-Type"), types) {
+		return h.expectFailed(r, ErrUnsupportedType)
+	}
+	if maxBody > 0 {
+		if r.ContentLength > maxBody {
+			return h.expectFailed(r, ErrTooLarge)
+		}
+		r.Body = &limitedBody{r.Body, maxBody}
+	}
+	return nil
+}
+
+// SetExpectStatus sets the status for requests with `Expect:
+// 100-continue` whose declared body is refused, e.g. 417. Zero keeps
+// 413 and 415. Either way the refusal is sent before the client sends
+// the body, since the body is never read.
+func (h *Handler) SetExpectStatus(status int) {
+	h.expectStatus = status
+}
+
+func (h *Handler) expectFailed(r *http.Request, err *HttpError) error {
+	if h.expectStatus == 0 || !strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		return err
+	}
+	return &HttpError{h.expectStatus, err.message}
+}
+
+// SetAllowedStatuses limits the statuses scripts may set with
+// WriteHeader to codes. By default any of 200 to 599 is allowed, so 1xx
+// like 101 Switching Protocols can not be sent by mistake.
+func (h *Handler) SetAllowedStatuses(codes ...int) {
+	allowed := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		allowed[code] = true
+	}
+	h.allowedStatuses = allowed
+}
+
+// allowStatus returns ErrStatusNotAllowed, and logs it, if the script of
+// the hook may not set code.
+func (h *hook) allowStatus(code int) error {
+	if h.handler.statusAllowed(code) {
+		return nil
+	}
+	log.Warningf("%s Script %q set status %d, which is not allowed", h.id, h.name, code)
+	return ErrStatusNotAllowed
+}
+
+func (h *Handler) statusAllowed(code int) bool {
+	if h.allowedStatuses == nil {
+		return code >= 200 && code <= 599
+	}
+	return h.allowedStatuses[code]
+}
+
+// SetRawHandler runs the script name for requests with a body ghoko does
+// not parse itself, anything but JSON and url encoded forms. The script
+// gets the body as ghoko.RawBody and the script the path points to as
+// ghoko.Request.Target. Empty, the default, runs the target anyway.
+func (h *Handler) SetRawHandler(name string) {
+	h.rawHandler = name
+}
+
+// nativeType reports whether ghoko parses the body of r itself.
+func nativeType(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return r.ContentLength == 0
+	}
+	if strings.Contains(ct, "json") {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	return err == nil && mt == "application/x-www-form-urlencoded"
+}
+
+func allowedType(ct string, types []string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if strings.EqualFold(mt, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedBody fails with ErrTooLarge once more than n bytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
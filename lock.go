@@ -0,0 +1,233 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikespook/golib/log"
+	"github.com/stevedonovan/luar"
+)
+
+// Locker hands out locks on keys expiring after ttl, so a crashed
+// holder does not keep them. owner identifies the holder, only it may
+// release the lock.
+type Locker interface {
+	Acquire(key, owner string, ttl time.Duration) (bool, error)
+	Release(key, owner string) error
+}
+
+// Pinger is implemented by Lockers which can tell if their store is up.
+type Pinger interface {
+	Ping() error
+}
+
+// SetLocker backs ghoko.Lock with l, e.g. NewRedisLocker to serialize
+// a critical section across instances. The default, NewMemLocker, only
+// locks within the process. If l is a Pinger, its store is checked and
+// the policy of SetLockerPolicy applied when it is down.
+func (h *Handler) SetLocker(l Locker) error {
+	if p, ok := l.(Pinger); ok {
+		if err := h.lockerBackend.setup(h.lockerPolicy, p.Ping); err != nil {
+			return err
+		}
+	} else {
+		h.lockerBackend.stop()
+	}
+	h.locker = l
+	return nil
+}
+
+type memLock struct {
+	owner   string
+	expires time.Time
+}
+
+// memLocker is the in-process Locker. Expired locks are swept whenever
+// the map doubles, so keys locked once do not stay forever.
+type memLocker struct {
+	sync.Mutex
+	locks   map[string]memLock
+	sweepAt int
+}
+
+const minSweep = 64
+
+// NewMemLocker returns a Locker for the instance alone.
+func NewMemLocker() Locker {
+	return &memLocker{locks: make(map[string]memLock), sweepAt: minSweep}
+}
+
+func (l *memLocker) Acquire(key, owner string, ttl time.Duration) (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if lk, ok := l.locks[key]; ok && now.Before(lk.expires) && lk.owner != owner {
+		return false, nil
+	}
+	l.locks[key] = memLock{owner, now.Add(ttl)}
+	if len(l.locks) >= l.sweepAt {
+		l.sweep(now)
+	}
+	return true, nil
+}
+
+// sweep deletes the expired locks.
+func (l *memLocker) sweep(now time.Time) {
+	for key, lk := range l.locks {
+		if !now.Before(lk.expires) {
+			delete(l.locks, key)
+		}
+	}
+	l.sweepAt = 2 * len(l.locks)
+	if l.sweepAt < minSweep {
+		l.sweepAt = minSweep
+	}
+}
+
+func (l *memLocker) Release(key, owner string) error {
+	l.Lock()
+	defer l.Unlock()
+	if lk, ok := l.locks[key]; ok && (lk.owner == owner || !time.Now().Before(lk.expires)) {
+		delete(l.locks, key)
+	}
+	return nil
+}
+
+// releaseScript deletes a Redis key only if it still holds the owner.
+const releaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// redisLocker locks with SET NX PX on a Redis server.
+type redisLocker struct {
+	addr    string
+	prefix  string
+	timeout time.Duration
+}
+
+// NewRedisLocker returns a Locker on the Redis server at addr, keys
+// prefixed with prefix. Every call opens a connection, given timeout.
+func NewRedisLocker(addr, prefix string, timeout time.Duration) Locker {
+	return &redisLocker{addr, prefix, timeout}
+}
+
+// do sends one command and reads its reply, a simple string, an
+// integer or a bulk string, nil for a null one.
+func (l *redisLocker) do(args ...string) (interface{}, error) {
+	conn, err := net.DialTimeout("tcp", l.addr, l.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if l.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(l.timeout))
+	}
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(cmd.String())); err != nil {
+		return nil, err
+	}
+	rd := bufio.NewReader(conn)
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (l *redisLocker) Acquire(key, owner string, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	reply, err := l.do("SET", l.prefix+key, owner, "NX", "PX", ms)
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+func (l *redisLocker) Release(key, owner string) error {
+	_, err := l.do("EVAL", releaseScript, "1", l.prefix+key, owner)
+	return err
+}
+
+func (l *redisLocker) Ping() error {
+	_, err := l.do("PING")
+	return err
+}
+
+// owner returns the lock owner of the hook. It is generated rather than
+// taken from the request id, which clients may choose.
+func (h *hook) owner() string {
+	if h.lockOwner == "" {
+		h.lockOwner = h.handler.idgen.Id().(string)
+	}
+	return h.lockOwner
+}
+
+// lockBinding is ghoko.Lock. Locks are owned by the execution and
+// released when the script is done, at the latest.
+func (h *hook) lockBinding() luar.Map {
+	return luar.Map{
+		"Acquire": func(key string, ttl float64) (bool, error) {
+			if ttl <= 0 {
+				return false, ErrBadTTL
+			}
+			if err := h.handler.lockerBackend.check(); err != nil {
+				return false, err
+			}
+			ok, err := h.handler.locker.Acquire(key, h.owner(), time.Duration(ttl*float64(time.Second)))
+			if ok {
+				h.locks.Store(key, true)
+			}
+			return ok, err
+		},
+		"Release": func(key string) error {
+			h.locks.Delete(key)
+			return h.handler.locker.Release(key, h.owner())
+		},
+	}
+}
+
+// releaseLocks releases the locks the script did not.
+func (h *hook) releaseLocks() {
+	h.locks.Range(func(k, _ interface{}) bool {
+		if err := h.handler.locker.Release(k.(string), h.owner()); err != nil {
+			log.Errorf("%s Release lock %q: %s", h.id, k, err)
+		}
+		h.locks.Delete(k)
+		return true
+	})
+}
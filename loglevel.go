@@ -0,0 +1,91 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+
+	"github.com/mikespook/golib/iptpool"
+	"github.com/mikespook/golib/log"
+)
+
+// LogLevel is the least severe level a script logs at. Messages pass
+// the -log-level of the process afterwards, so that one has to be at
+// least as verbose.
+type LogLevel int
+
+const (
+	// LogDefault logs everything, unless SetLogLevel says otherwise.
+	LogDefault LogLevel = iota
+	LogDebug
+	LogMessage
+	LogWarning
+	LogError
+	LogNone
+)
+
+// SetLogLevel sets the level of every script without its own.
+func (h *Handler) SetLogLevel(level LogLevel) {
+	h.logLevel = level
+}
+
+// SetLogLevelFor sets the level of the script name, e.g. LogDebug for
+// one script being debugged while the others stay at LogWarning. Above
+// LogMessage, its requests are only access logged when they fail with
+// 5xx, and beyond LogError not at all.
+func (h *Handler) SetLogLevelFor(name string, level LogLevel) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.logLevel = level
+	})
+}
+
+// scriptLogLevel is the level of the script name.
+func (h *Handler) scriptLogLevel(name string) LogLevel {
+	if level := h.lookup(name).logLevel; level != LogDefault {
+		return level
+	}
+	return h.logLevel
+}
+
+// logs reports whether the hook logs at level.
+func (h *hook) logs(level LogLevel) bool {
+	return h.handler.scriptLogLevel(h.name) <= level
+}
+
+// accessLogged reports whether the request of the hook, answered with
+// status, goes to the access log.
+func (h *hook) accessLogged(status int) bool {
+	if status >= http.StatusInternalServerError {
+		return h.logs(LogError)
+	}
+	return h.logs(LogMessage)
+}
+
+// bindLog binds the log functions filtered by the level of the script.
+func (h *hook) bindLog(ipt iptpool.ScriptIpt) {
+	logf := func(level LogLevel, f func(string, ...interface{})) func(string, ...interface{}) {
+		return func(format string, v ...interface{}) {
+			if h.logs(level) {
+				f(format, v...)
+			}
+		}
+	}
+	logv := func(level LogLevel, f func(...interface{})) func(...interface{}) {
+		return func(v ...interface{}) {
+			if h.logs(level) {
+				f(v...)
+			}
+		}
+	}
+	ipt.Bind("Debugf", logf(LogDebug, log.Debugf))
+	ipt.Bind("Debug", logv(LogDebug, log.Debug))
+	ipt.Bind("Messagef", logf(LogMessage, log.Messagef))
+	ipt.Bind("Message", logv(LogMessage, log.Message))
+	ipt.Bind("Warningf", logf(LogWarning, log.Warningf))
+	ipt.Bind("Warning", logv(LogWarning, log.Warning))
+	ipt.Bind("Errorf", logf(LogError, log.Errorf))
+	ipt.Bind("Error", logv(LogError, log.Error))
+}
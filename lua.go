@@ -6,18 +6,97 @@
 package ghoko
 
 import (
+	"errors"
+	"fmt"
 	"github.com/aarzilli/golua/lua"
 	"github.com/mikespook/golib/iptpool"
 	"github.com/mikespook/golib/log"
 	"github.com/stevedonovan/luar"
+	"io/fs"
+	"io/ioutil"
 	"path"
+	"sync/atomic"
+	"time"
 )
 
 const module = "ghoko"
 
+// deadliner is implemented by interpreters able to abort scripts
+// running past a deadline.
+type deadliner interface {
+	SetDeadline(t time.Time)
+}
+
+// hookScript aborts the running script once the deadline has passed,
+// or once the Lua heap grows beyond the memory limit. Go functions can
+// not be interrupted, so a script blocked in a binding is aborted when
+// it returns to Lua.
+const hookScript = `
+local limits, exceeded, count = ghoko.limits, ghoko.exceeded, collectgarbage
+ghoko.limits, ghoko.exceeded = nil, nil
+debug.sethook(function()
+	local expired, limit = limits()
+	if expired then
+		error("script timed out", 2)
+	end
+	if limit > 0 and count("count") > limit then
+		exceeded()
+		error("script memory limit exceeded", 2)
+	end
+end, "", 1000)
+`
+
+// snapshotScript records the globals and defines a function restoring
+// them: new globals are removed and replaced ones are put back.
+const snapshotScript = `
+local snapshot = {}
+for k, v in pairs(_G) do
+	snapshot[k] = v
+end
+__ghoko_reset = function()
+	for k, v in pairs(_G) do
+		if snapshot[k] ~= v then
+			_G[k] = snapshot[k]
+		end
+	end
+	for k, v in pairs(snapshot) do
+		if _G[k] == nil then
+			_G[k] = v
+		end
+	end
+end
+snapshot.__ghoko_reset = __ghoko_reset
+`
+
+// paramsScript makes reading ghoko.Params, when it is not set, decode
+// the params of ExecLazy. A script reading other missing fields of the
+// module gets nil as before.
+const paramsScript = `
+local params, rawset = ghoko.params, rawset
+ghoko.params = nil
+setmetatable(ghoko, {__index = function(t, k)
+	if k ~= "Params" then
+		return nil
+	end
+	local p = params()
+	if p == nil then
+		error("invalid params", 2)
+	end
+	rawset(t, "Params", p)
+	return p
+end})
+`
+
 type LuaIpt struct {
-	state *lua.State
-	path  string
+	state       *lua.State
+	path        string
+	deadline    int64
+	hasSnapshot bool
+	fsys        fs.FS
+	worker      int64
+	memLimit    int64 // in KB, as collectgarbage counts
+	overMemory  bool
+	lazyParams  func() Params
 }
 
 func NewLuaIpt() iptpool.ScriptIpt {
@@ -25,9 +104,117 @@ func NewLuaIpt() iptpool.ScriptIpt {
 }
 
 func (luaipt *LuaIpt) Exec(name string, params interface{}) error {
-	f := path.Join(luaipt.path, name+".lua")
 	luaipt.Bind("Params", params)
-	return luaipt.state.DoFile(f)
+	if err := luaipt.load(name); err != nil {
+		if luaipt.expired() {
+			return ErrTimeout
+		}
+		if luaipt.overMemory {
+			return ErrMemoryLimit
+		}
+		return err
+	}
+	return nil
+}
+
+// ExecLazy is Exec with the params decoded by load only once the script
+// reads ghoko.Params. load returns nil if they are invalid.
+func (luaipt *LuaIpt) ExecLazy(name string, load func() Params) error {
+	luaipt.lazyParams = load
+	defer func() { luaipt.lazyParams = nil }()
+	return luaipt.Exec(name, nil)
+}
+
+// params is ghoko.params, called by paramsScript. It returns an untyped
+// nil for Lua to see nil.
+func (luaipt *LuaIpt) params() interface{} {
+	if luaipt.lazyParams == nil {
+		return nil
+	}
+	if p := luaipt.lazyParams(); p != nil {
+		return p
+	}
+	return nil
+}
+
+// SetMemoryLimit aborts scripts once the Lua heap of the interpreter
+// is over n bytes. Zero means no limit.
+func (luaipt *LuaIpt) SetMemoryLimit(n int64) {
+	atomic.StoreInt64(&luaipt.memLimit, n/1024)
+}
+
+// Broken reports whether the interpreter went over its memory limit and
+// should not be used again.
+func (luaipt *LuaIpt) Broken() bool {
+	return luaipt.overMemory
+}
+
+func (luaipt *LuaIpt) limits() (bool, float64) {
+	return luaipt.expired(), float64(atomic.LoadInt64(&luaipt.memLimit))
+}
+
+func (luaipt *LuaIpt) exceeded() {
+	luaipt.overMemory = true
+}
+
+// load runs the script name from the directory, or from the file system
+// set with SetFS.
+func (luaipt *LuaIpt) load(name string) error {
+	if luaipt.fsys == nil {
+		return luaipt.state.DoFile(path.Join(luaipt.path, name+".lua"))
+	}
+	src, err := fs.ReadFile(luaipt.fsys, name+".lua")
+	if err != nil {
+		return err
+	}
+	return luaipt.state.DoString(string(src))
+}
+
+// Compile checks that the script name compiles, without running it.
+func (luaipt *LuaIpt) Compile(name string) error {
+	var src []byte
+	var err error
+	if luaipt.fsys == nil {
+		src, err = ioutil.ReadFile(path.Join(luaipt.path, name+".lua"))
+	} else {
+		src, err = fs.ReadFile(luaipt.fsys, name+".lua")
+	}
+	if err != nil {
+		return err
+	}
+	if luaipt.state.LoadString(string(src)) != 0 {
+		err = errors.New(luaipt.state.ToString(-1))
+	}
+	luaipt.state.Pop(1)
+	return err
+}
+
+// SetFS makes scripts be loaded from fsys instead of the directory.
+func (luaipt *LuaIpt) SetFS(fsys fs.FS) {
+	luaipt.fsys = fsys
+}
+
+// SetWorkerId sets the id of the interpreter in the pool.
+func (luaipt *LuaIpt) SetWorkerId(id int64) {
+	luaipt.worker = id
+}
+
+// WorkerId is the id of the interpreter in the pool, 0 if not set.
+func (luaipt *LuaIpt) WorkerId() int64 {
+	return luaipt.worker
+}
+
+func (luaipt *LuaIpt) SetDeadline(t time.Time) {
+	var d int64
+	if !t.IsZero() {
+		d = t.UnixNano()
+	}
+	atomic.StoreInt64(&luaipt.deadline, d)
+}
+
+func (luaipt *LuaIpt) expired() bool {
+	d := atomic.LoadInt64(&luaipt.deadline)
+	return d != 0 && time.Now().UnixNano() > d
 }
 
 func (luaipt *LuaIpt) Init(path string) error {
@@ -40,8 +227,30 @@ func (luaipt *LuaIpt) Init(path string) error {
 	luaipt.Bind("Warning", log.Warning)
 	luaipt.Bind("Errorf", log.Errorf)
 	luaipt.Bind("Error", log.Error)
+	luaipt.Bind("limits", luaipt.limits)
+	luaipt.Bind("exceeded", luaipt.exceeded)
+	luaipt.Bind("params", luaipt.params)
 	luaipt.path = path
-	return nil
+	if err := luaipt.state.DoString(hookScript); err != nil {
+		return err
+	}
+	return luaipt.state.DoString(paramsScript)
+}
+
+func (luaipt *LuaIpt) Sandbox(allowed []string) error {
+	return luaipt.state.DoString(fmt.Sprintf(sandboxScript, luaStrings(allowed)))
+}
+
+func (luaipt *LuaIpt) Snapshot() error {
+	luaipt.hasSnapshot = true
+	return luaipt.state.DoString(snapshotScript)
+}
+
+func (luaipt *LuaIpt) Reset() error {
+	if !luaipt.hasSnapshot {
+		return nil
+	}
+	return luaipt.state.DoString("__ghoko_reset()")
 }
 
 func (luaipt *LuaIpt) Final() error {
@@ -0,0 +1,44 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+const maintenanceRetryAfter = 60
+
+// SetMaintenance stops executing hooks while on is true. Hook requests
+// get 503 with a Retry-After header, other endpoints keep answering.
+func (h *Handler) SetMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&h.maintenance, v)
+}
+
+func (h *Handler) InMaintenance() bool {
+	return atomic.LoadInt32(&h.maintenance) == 1
+}
+
+// serveMaintenance reports the maintenance mode, and switches it when
+// the `on` parameter is given.
+func (h *Handler) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if v := r.URL.Query().Get("on"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			h.writeAndLogError(w, r, ErrBadRequest)
+			return
+		}
+		h.SetMaintenance(on)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.writeAndLog(w, r, http.StatusOK, []byte(fmt.Sprintf(`{"maintenance":%t}`, h.InMaintenance())))
+}
@@ -0,0 +1,88 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/stevedonovan/luar"
+)
+
+// SetTrustedProxies sets the CIDRs of proxies whose X-Forwarded-For
+// header is believed when working out the client IP, see ClientIP.
+// Single IPs can be given as /32 or /128.
+func (h *Handler) SetTrustedProxies(cidrs []string) error {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	h.trustedProxies = nets
+	return nil
+}
+
+func (h *Handler) trusted(ip net.IP) bool {
+	for _, n := range h.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client of r. X-Forwarded-For is only
+// believed when the remote address is a trusted proxy, and is walked
+// from the right while the hops are trusted proxies; the first
+// untrusted hop is the client. Every IP based feature of ghoko, from
+// access logs to scripts, goes through it, so blindly trusting a
+// spoofed header in one place can not undo the others.
+func (h *Handler) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !h.trusted(ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !h.trusted(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func netBinding() luar.Map {
+	return luar.Map{
+		"ParseIP": func(s string) string {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return ""
+			}
+			return ip.String()
+		},
+		"IPInCIDR": func(s, cidr string) (bool, error) {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return false, err
+			}
+			ip := net.ParseIP(s)
+			return ip != nil && n.Contains(ip), nil
+		},
+	}
+}
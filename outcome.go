@@ -0,0 +1,50 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import "sync"
+
+// maxOutcomes bounds the distinct tags counted for /status. Later tags
+// are counted as otherOutcome.
+const (
+	maxOutcomes   = 64
+	maxOutcomeLen = 32
+	otherOutcome  = "other"
+)
+
+// outcomes counts the executions per outcome tag.
+type outcomes struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+func (o *outcomes) add(tag string) {
+	o.Lock()
+	defer o.Unlock()
+	if _, ok := o.counts[tag]; !ok && len(o.counts) >= maxOutcomes {
+		tag = otherOutcome
+	}
+	o.counts[tag]++
+}
+
+func (o *outcomes) snapshot() map[string]int64 {
+	o.Lock()
+	defer o.Unlock()
+	counts := make(map[string]int64, len(o.counts))
+	for tag, n := range o.counts {
+		counts[tag] = n
+	}
+	return counts
+}
+
+// setOutcome implements the SetOutcome binding.
+func (h *hook) setOutcome(tag string) error {
+	if len(tag) > maxOutcomeLen || !isToken(tag) {
+		return ErrInvalidOutcome
+	}
+	h.outcome = tag
+	return nil
+}
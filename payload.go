@@ -0,0 +1,54 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+)
+
+// SetPayloadKey makes JSON bodies be decrypted with AES-GCM before they
+// are parsed. The body is the base64 encoded nonce followed by the
+// sealed JSON. The key must be 16, 24 or 32 bytes; nil turns it off.
+func (h *Handler) SetPayloadKey(key []byte) error {
+	if key == nil {
+		h.payload = nil
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	h.payload = aead
+	return nil
+}
+
+// decrypt opens an encrypted body. Bodies are left alone when no key
+// is set.
+func (h *Handler) decrypt(data []byte) ([]byte, error) {
+	if h.payload == nil {
+		return data, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, ErrUndecryptable
+	}
+	n := h.payload.NonceSize()
+	if len(raw) < n {
+		return nil, ErrUndecryptable
+	}
+	plain, err := h.payload.Open(nil, raw[:n], raw[n:], nil)
+	if err != nil {
+		return nil, ErrUndecryptable
+	}
+	return plain, nil
+}
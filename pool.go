@@ -0,0 +1,337 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikespook/golib/iptpool"
+	"github.com/mikespook/golib/log"
+)
+
+// InitPolicy decides what happens when a new interpreter can not be
+// created, e.g. because the script directory was unmounted.
+type InitPolicy int
+
+const (
+	// InitKeepServing waits for one of the interpreters created earlier
+	// to be free. Requests are only refused when there is none at all.
+	InitKeepServing InitPolicy = iota
+	// InitUnavailable refuses the request with 503 right away, and
+	// makes the status endpoint fail until an interpreter is created.
+	InitUnavailable
+)
+
+// SetInitPolicy sets what happens when creating an interpreter fails.
+// The default is InitKeepServing.
+func (h *Handler) SetInitPolicy(policy InitPolicy) {
+	h.initPolicy = policy
+}
+
+// generation is an interpreter pool together with the executions still
+// using it, so a replaced pool can be freed once they are done.
+type generation struct {
+	created int64 // first for 64-bit atomic alignment
+	mu      sync.Mutex
+	cond    *sync.Cond
+	idle    []idleIpt // oldest first
+	live    int
+	wg      sync.WaitGroup
+}
+
+// idleIpt is an interpreter in the pool, since when it is there and
+// how many executions it ran.
+type idleIpt struct {
+	iptpool.ScriptIpt
+	since time.Time
+	execs int
+}
+
+// pooledIpt remembers which generation an interpreter came from, and
+// how many executions it ran, this one included.
+type pooledIpt struct {
+	iptpool.ScriptIpt
+	gen   *generation
+	execs int
+}
+
+func (h *Handler) newGeneration() *generation {
+	gen := &generation{}
+	gen.cond = sync.NewCond(&gen.mu)
+	return gen
+}
+
+// create makes a new interpreter, keeping count of consecutive failures.
+func (h *Handler) create() (iptpool.ScriptIpt, error) {
+	ipt := NewLuaIpt()
+	if err := h.onCreate(ipt); err != nil {
+		ipt.Final()
+		n := atomic.AddInt64(&h.stats.initFailures, 1)
+		log.Errorf("Create interpreter (%d consecutive failures): %s", n, err)
+		return nil, ErrUnavailable
+	}
+	atomic.StoreInt64(&h.stats.initFailures, 0)
+	return ipt, nil
+}
+
+func (gen *generation) get(h *Handler) (idleIpt, error) {
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	for {
+		if n := len(gen.idle); n > 0 {
+			ipt := gen.idle[n-1]
+			gen.idle = gen.idle[:n-1]
+			return ipt, nil
+		}
+		gen.mu.Unlock()
+		ipt, err := h.create()
+		gen.mu.Lock()
+		if err == nil {
+			gen.live++
+			atomic.AddInt64(&gen.created, 1)
+			return idleIpt{ScriptIpt: ipt}, nil
+		}
+		if h.initPolicy == InitUnavailable || gen.live == 0 {
+			return idleIpt{}, err
+		}
+		gen.cond.Wait()
+	}
+}
+
+func (gen *generation) put(ipt iptpool.ScriptIpt, execs int) {
+	gen.mu.Lock()
+	gen.idle = append(gen.idle, idleIpt{ipt, time.Now(), execs})
+	gen.mu.Unlock()
+	gen.cond.Signal()
+}
+
+// discard finalizes an interpreter taken from the pool instead of
+// putting it back, so the next get creates a new one.
+func (gen *generation) discard(ipt iptpool.ScriptIpt) {
+	gen.mu.Lock()
+	gen.live--
+	gen.mu.Unlock()
+	gen.cond.Signal()
+	finalize([]idleIpt{{ScriptIpt: ipt}})
+}
+
+// free finalizes the idle interpreters.
+func (gen *generation) free() {
+	gen.mu.Lock()
+	idle := gen.idle
+	gen.idle = nil
+	gen.live -= len(idle)
+	gen.mu.Unlock()
+	finalize(idle)
+}
+
+// reap finalizes the interpreters idle for longer than d, keeping at
+// least min interpreters alive.
+func (gen *generation) reap(d time.Duration, min int) {
+	deadline := time.Now().Add(-d)
+	gen.mu.Lock()
+	n := 0
+	for n < len(gen.idle) && gen.live-n > min && gen.idle[n].since.Before(deadline) {
+		n++
+	}
+	expired := append([]idleIpt(nil), gen.idle[:n]...)
+	gen.idle = append(gen.idle[:0], gen.idle[n:]...)
+	gen.live -= n
+	gen.mu.Unlock()
+	finalize(expired)
+}
+
+func finalize(ipts []idleIpt) {
+	for _, ipt := range ipts {
+		if err := ipt.Final(); err != nil {
+			log.Errorf("Free interpreter: %s", err)
+		}
+	}
+}
+
+// SetIdleTimeout frees interpreters which were not used for d, down to
+// the minimum of SetMinPoolSize. They are created again on demand. Zero
+// keeps idle interpreters forever, which is the default.
+func (h *Handler) SetIdleTimeout(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopReaper != nil {
+		close(h.stopReaper)
+		h.stopReaper = nil
+	}
+	if d <= 0 {
+		return
+	}
+	h.stopReaper = make(chan struct{})
+	go h.reaper(d, h.stopReaper)
+}
+
+// SetMinPoolSize keeps at least n interpreters when idle ones are freed.
+func (h *Handler) SetMinPoolSize(n int) {
+	atomic.StoreInt32(&h.minPool, int32(n))
+}
+
+func (h *Handler) reaper(d time.Duration, stop chan struct{}) {
+	interval := d / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		h.mu.RLock()
+		gen := h.gen
+		h.mu.RUnlock()
+		gen.reap(d, int(atomic.LoadInt32(&h.minPool)))
+	}
+}
+
+// warm creates n interpreters in the pool ahead of use.
+func (gen *generation) warm(h *Handler, n int) {
+	ipts := make([]idleIpt, 0, n)
+	for i := 0; i < n; i++ {
+		ipt, err := gen.get(h)
+		if err != nil {
+			break
+		}
+		ipts = append(ipts, ipt)
+	}
+	for _, ipt := range ipts {
+		gen.put(ipt.ScriptIpt, ipt.execs)
+	}
+}
+
+func (h *Handler) getIpt() (*pooledIpt, error) {
+	h.mu.RLock()
+	if h.closed {
+		h.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	gen := h.gen
+	gen.wg.Add(1)
+	h.mu.RUnlock()
+	ipt, err := gen.get(h)
+	if err != nil {
+		gen.wg.Done()
+		return nil, err
+	}
+	atomic.AddInt64(&h.stats.inUse, 1)
+	return &pooledIpt{ipt.ScriptIpt, gen, ipt.execs + 1}, nil
+}
+
+// resetter is implemented by interpreters able to drop the globals a
+// script left behind.
+type resetter interface {
+	Snapshot() error
+	Reset() error
+}
+
+// SetMaxExecsPerInterpreter recycles interpreters after n executions,
+// bounding what a long-lived Lua state can leak. The next request gets
+// a new interpreter. Zero, the default, keeps them.
+func (h *Handler) SetMaxExecsPerInterpreter(n int) {
+	atomic.StoreInt32(&h.maxExecs, int32(n))
+}
+
+// memoryLimiter is implemented by interpreters able to abort scripts
+// using too much memory.
+type memoryLimiter interface {
+	SetMemoryLimit(n int64)
+}
+
+// broken is implemented by interpreters which can be left unusable by
+// an execution, and are then freed instead of going back to the pool.
+type broken interface {
+	Broken() bool
+}
+
+// SetScriptMemoryLimit aborts scripts once the Lua heap of their
+// interpreter is over n bytes, with a 500. The interpreter is freed
+// afterwards rather than reused. Zero, the default, means no limit.
+func (h *Handler) SetScriptMemoryLimit(n int) {
+	h.memoryLimit = int64(n)
+}
+
+// identifier is implemented by interpreters keeping the worker id
+// assigned to them when created.
+type identifier interface {
+	SetWorkerId(id int64)
+	WorkerId() int64
+}
+
+// SetResetGlobals snapshots the globals of every new interpreter and
+// restores them after each execution, so globals set by one request do
+// not leak into the next one using the same interpreter. It only affects
+// interpreters created afterwards, see Reload.
+func (h *Handler) SetResetGlobals(reset bool) {
+	h.resetGlobals = reset
+}
+
+func (h *Handler) putIpt(ipt *pooledIpt) {
+	if r, ok := ipt.ScriptIpt.(resetter); ok && h.resetGlobals {
+		if err := r.Reset(); err != nil {
+			log.Errorf("Reset globals: %s", err)
+		}
+	}
+	if b, ok := ipt.ScriptIpt.(broken); ok && b.Broken() {
+		ipt.gen.discard(ipt.ScriptIpt)
+	} else if max := atomic.LoadInt32(&h.maxExecs); max > 0 && ipt.execs >= int(max) {
+		ipt.gen.discard(ipt.ScriptIpt)
+	} else {
+		ipt.gen.put(ipt.ScriptIpt, ipt.execs)
+	}
+	atomic.AddInt64(&h.stats.inUse, -1)
+	ipt.gen.wg.Done()
+}
+
+// Reload replaces the interpreter pool with a fresh one, so scripts and
+// modules loaded by `require` are read again. Executions in flight finish
+// on the old pool, which is freed afterwards. The config file of
+// LoadConfig is read again as well, with the secret, allowed scripts and
+// aliases it sets, and new interpreters bind the new secret.
+func (h *Handler) Reload() {
+	h.reloadConfig()
+	h.swap(h.newGeneration())
+}
+
+// DrainPool recycles the interpreters, e.g. to get rid of globals leaked
+// by scripts. A new pool is warmed with as many interpreters as the old
+// one created, but at most max, before it takes over, so requests do not
+// pay for creating them. The old interpreters are freed once idle.
+func (h *Handler) DrainPool(max int) {
+	h.mu.RLock()
+	n := int(atomic.LoadInt64(&h.gen.created))
+	h.mu.RUnlock()
+	if n > max {
+		n = max
+	}
+	gen := h.newGeneration()
+	gen.warm(h, n)
+	h.swap(gen)
+}
+
+func (h *Handler) swap(gen *generation) {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		gen.free()
+		return
+	}
+	old := h.gen
+	h.gen = gen
+	h.mu.Unlock()
+	go func() {
+		old.wg.Wait()
+		old.free()
+	}()
+}
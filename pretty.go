@@ -0,0 +1,44 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SetBrowserPretty pretty prints JSON responses to clients accepting
+// text/html, i.e. browsers, as if they passed ?pretty=true.
+func (h *Handler) SetBrowserPretty(enabled bool) {
+	h.browserPretty = enabled
+}
+
+func (h *Handler) wantsPretty(r *http.Request) bool {
+	if pretty, err := strconv.ParseBool(r.URL.Query().Get("pretty")); err == nil {
+		return pretty
+	}
+	return h.browserPretty && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// prettify indents a JSON response body if the client asked for it.
+// Bodies which are not valid JSON are left alone.
+func (h *Handler) prettify(w http.ResponseWriter, r *http.Request, data []byte) []byte {
+	if len(data) == 0 || !strings.Contains(w.Header().Get("Content-Type"), "json") || !h.wantsPretty(r) {
+		return data
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return data
+	}
+	buf.WriteByte('\n')
+	if w.Header().Get("Content-Length") != "" {
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	}
+	return buf.Bytes()
+}
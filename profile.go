@@ -0,0 +1,68 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"time"
+
+	"github.com/stevedonovan/luar"
+)
+
+// Profile is a set of settings for one environment, e.g. staging or
+// production.
+type Profile struct {
+	// Env is exposed to scripts as ghoko.Env.
+	Env map[string]string
+	// Timeouts override the script timeout per script name.
+	Timeouts map[string]time.Duration
+	// SyncModes override the sync mode per script name.
+	SyncModes map[string]SyncMode
+}
+
+// AddProfile registers the profile p under name.
+func (h *Handler) AddProfile(name string, p Profile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.profiles[name] = p
+}
+
+// SetProfile activates the profile name. Interpreters created before
+// keep the old ghoko.Env until Reload.
+func (h *Handler) SetProfile(name string) error {
+	h.mu.Lock()
+	p, ok := h.profiles[name]
+	if ok {
+		h.profile = name
+	}
+	h.mu.Unlock()
+	if !ok {
+		return ErrUnknownProfile
+	}
+	for script, d := range p.Timeouts {
+		h.SetTimeoutFor(script, d)
+	}
+	for script, mode := range p.SyncModes {
+		h.SetSyncModeFor(script, mode)
+	}
+	return nil
+}
+
+// Profile returns the name of the active profile.
+func (h *Handler) Profile() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.profile
+}
+
+func (h *Handler) envBinding() luar.Map {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	env := make(luar.Map)
+	for k, v := range h.profiles[h.profile].Env {
+		env[k] = v
+	}
+	return env
+}
@@ -0,0 +1,71 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"sync/atomic"
+
+	"github.com/mikespook/golib/log"
+)
+
+// Delivery is an async hook request handed to a Publisher instead of
+// being executed.
+type Delivery struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// ResultId is the id the result is stored under, see SetResultStore.
+	ResultId string `json:"result_id"`
+	Params   Params `json:"params"`
+}
+
+// Publisher sends deliveries to a message queue, e.g. Kafka, NATS or
+// RabbitMQ. Publish must be safe for concurrent use.
+type Publisher interface {
+	Publish(d Delivery) error
+}
+
+// SetPublisher publishes async hook requests to p once they are
+// validated, instead of running them, and answers with their id. A
+// consumer runs them later, e.g. with Consume. Sync requests still run
+// right away. Nil executes async requests again.
+func (h *Handler) SetPublisher(p Publisher) {
+	h.publisher = p
+}
+
+// publish hands the hook to the publisher.
+func (h *hook) publish() error {
+	if err := h.loadParams(); err != nil {
+		return err
+	}
+	d := Delivery{Id: h.id, Name: h.name, ResultId: h.resultKey(), Params: h.params}
+	if err := h.handler.publisher.Publish(d); err != nil {
+		log.Errorf("%s Publish %q: %s", h.id, h.name, err)
+		return ErrNotPublished
+	}
+	return nil
+}
+
+// Consume runs a published delivery on the pool, sync, keeping its id.
+// It returns what the script wrote.
+func (h *Handler) Consume(d Delivery) ([]byte, error) {
+	name, ok := h.resolvedName(d.Name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if d.Params == nil {
+		d.Params = make(Params)
+	}
+	atomic.AddInt64(&h.stats.requests, 1)
+	hk := h.internalHook(name, d.Params)
+	if d.Id != "" {
+		hk.id = d.Id
+	}
+	if d.ResultId != "" {
+		hk.resultId = d.ResultId
+	}
+	_, data, err := hk.execute()
+	return data, err
+}
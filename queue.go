@@ -0,0 +1,158 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"container/heap"
+	"strconv"
+	"sync"
+)
+
+const defaultMaxQueued = 10000
+
+// job is async work waiting for a worker.
+type job struct {
+	priority int
+	seq      uint64
+	f        func()
+}
+
+// jobQueue is a heap of jobs, higher priorities first and in order of
+// arrival within a priority.
+type jobQueue []*job
+
+func (q jobQueue) Len() int { return len(q) }
+
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *jobQueue) Push(x interface{}) { *q = append(*q, x.(*job)) }
+
+func (q *jobQueue) Pop() interface{} {
+	old := *q
+	j := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return j
+}
+
+type workers struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	jobs jobQueue
+	seq  uint64
+}
+
+// SetAsyncWorkers runs async executions on n workers taking the queued
+// jobs by priority. By default every async execution gets its own
+// goroutine right away. Call it once, before serving.
+func (h *Handler) SetAsyncWorkers(n int) {
+	if n <= 0 {
+		return
+	}
+	w := &workers{}
+	w.cond = sync.NewCond(&w.mu)
+	for i := 0; i < n; i++ {
+		go w.run()
+	}
+	h.workers = w
+}
+
+// SetMaxQueuedJobs caps the jobs waiting for async workers. Async
+// requests beyond get 503. Zero keeps the default of 10000.
+func (h *Handler) SetMaxQueuedJobs(n int) {
+	h.maxQueued = n
+}
+
+// SetPriorityFor sets the priority of async executions of the script
+// name. The default is zero and higher runs first.
+func (h *Handler) SetPriorityFor(name string, priority int) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.priority = priority
+	})
+}
+
+// SetMaxClientPriority lets clients raise the priority of a request with
+// the `_priority` query param, up to max but never below the priority of
+// the script. Zero ignores the param.
+func (h *Handler) SetMaxClientPriority(max int) {
+	h.maxClientPriority = max
+}
+
+// priority returns the priority of the hook. The `_priority` param is
+// taken out of the params once read.
+func (h *hook) priority() int {
+	p := h.handler.lookup(h.name).priority
+	if h.handler.maxClientPriority == 0 {
+		return p
+	}
+	h.loadParams()
+	delete(h.params, "_priority")
+	if v, err := strconv.Atoi(h.r.URL.Query().Get("_priority")); err == nil {
+		if v > h.handler.maxClientPriority {
+			v = h.handler.maxClientPriority
+		}
+		if v > p {
+			p = v
+		}
+	}
+	return p
+}
+
+func (w *workers) push(priority, max int, f func()) error {
+	w.mu.Lock()
+	if len(w.jobs) >= max {
+		w.mu.Unlock()
+		return ErrQueueFull
+	}
+	w.seq++
+	heap.Push(&w.jobs, &job{priority, w.seq, f})
+	w.mu.Unlock()
+	w.cond.Signal()
+	return nil
+}
+
+func (w *workers) run() {
+	for {
+		w.mu.Lock()
+		for len(w.jobs) == 0 {
+			w.cond.Wait()
+		}
+		j := heap.Pop(&w.jobs).(*job)
+		w.mu.Unlock()
+		j.f()
+	}
+}
+
+// async runs f in the background, the way async hooks are executed. It
+// fails if the queue of the workers is full.
+func (h *Handler) async(priority int, f func()) error {
+	if h.workers == nil {
+		go f()
+		return nil
+	}
+	max := h.maxQueued
+	if max == 0 {
+		max = defaultMaxQueued
+	}
+	return h.workers.push(priority, max, f)
+}
+
+// enqueue implements the Enqueue binding: the script name is run
+// asynchronously with params, and the id of that run is returned.
+func (h *Handler) enqueue(name string, params Params) (string, error) {
+	hk := h.internalHook(name, params)
+	hk.isSync = false
+	err := h.async(h.lookup(name).priority, func() {
+		hk.execute()
+	})
+	return hk.id, err
+}
@@ -0,0 +1,74 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket refilled at rate tokens per second up to
+// burst.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token, or tells how long until the next one.
+func (b *bucket) take() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// SetRateLimitFor allows rate requests per second with bursts of burst
+// to the script name. Others get 429 with a Retry-After header, while
+// other scripts are not affected. A zero rate removes the limit.
+func (h *Handler) SetRateLimitFor(name string, rate float64, burst int) {
+	b := newBucket(rate, burst)
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.limiter = b
+	})
+}
+
+// newBucket returns a full bucket, or nil for a zero rate.
+func newBucket(rate float64, burst int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// checkRate takes a token of the script name, setting Retry-After on w
+// when there is none.
+func (h *Handler) checkRate(w http.ResponseWriter, name string) error {
+	b := h.lookup(name).limiter
+	if b == nil {
+		return nil
+	}
+	wait, ok := b.take()
+	if ok {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return ErrScriptRateLimited
+}
@@ -0,0 +1,137 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mikespook/golib/log"
+)
+
+// Recording is a request written by the recorder, one JSON object per
+// line of the file.
+type Recording struct {
+	Time   time.Time   `json:"time"`
+	Id     string      `json:"id"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Script string      `json:"script"`
+	Params Params      `json:"params"`
+	Sync   bool        `json:"sync"`
+}
+
+// recorder appends recordings to a file.
+type recorder struct {
+	sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// SetRecordFile records every hook request, with its resolved script
+// and params, to path for Replay. The secret is left out. An empty path
+// stops recording. It is meant for testing, not for production load.
+func (h *Handler) SetRecordFile(path string) error {
+	if h.recorder != nil {
+		h.recorder.close()
+		h.recorder = nil
+	}
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	h.recorder = &recorder{file: f, enc: json.NewEncoder(f)}
+	return nil
+}
+
+func (rec *recorder) close() {
+	rec.Lock()
+	defer rec.Unlock()
+	rec.file.Close()
+}
+
+// teeBody keeps a copy of what is read from a request body.
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// capture makes r keep a copy of its body for record.
+func (h *Handler) capture(r *http.Request) *bytes.Buffer {
+	if h.recorder == nil || r.Body == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	r.Body = teeBody{io.TeeReader(r.Body, &buf), r.Body}
+	return &buf
+}
+
+// record writes the request of hk, whose body was captured into body.
+func (h *Handler) record(hk *hook, body *bytes.Buffer) {
+	if h.recorder == nil {
+		return
+	}
+	// Recordings hold the decoded params.
+	hk.loadParams()
+	header := hk.r.Header.Clone()
+	if name := h.secretLocs.Header; name != "" {
+		header.Del(name)
+	}
+	rec := Recording{
+		Time:   time.Now(),
+		Id:     hk.id,
+		Method: hk.r.Method,
+		URL:    h.redact(hk.r.URL.String()),
+		Header: header,
+		Script: hk.name,
+		Params: hk.params,
+		Sync:   hk.isSync,
+	}
+	if body != nil {
+		rec.Body = []byte(h.redact(body.String()))
+	}
+	h.recorder.Lock()
+	defer h.recorder.Unlock()
+	if err := h.recorder.enc.Encode(rec); err != nil {
+		log.Errorf("%s Record request: %s", hk.id, err)
+	}
+}
+
+// Replay runs the requests recorded in file again through Execute, in
+// order, and calls f, if not nil, with each recording and the result.
+// Params come back from JSON, so lists of form values are arrays of any
+// type. It stops at the first line which can not be decoded.
+func (h *Handler) Replay(file string, f func(rec Recording, body []byte, err error)) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	dec := json.NewDecoder(bufio.NewReader(fp))
+	for {
+		var rec Recording
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		_, body, err := h.Execute(rec.Script, rec.Params, rec.Sync)
+		if f != nil {
+			f(rec, body, err)
+		}
+	}
+}
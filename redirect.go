@@ -0,0 +1,58 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+	"strings"
+)
+
+var redirectStatus = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// redirect implements the Redirect binding. The response gets no body.
+func (h *hook) redirect(url string, status int) error {
+	if !h.isSync {
+		return ErrSyncNeeded
+	}
+	if !redirectStatus[status] {
+		return ErrNotRedirect
+	}
+	if h.body.Len() > 0 || h.streamed {
+		return ErrBodyWritten
+	}
+	if url == "" || strings.ContainsAny(url, "\r\n") {
+		return ErrInvalidHeader
+	}
+	if err := h.allowStatus(status); err != nil {
+		return err
+	}
+	h.w.Header().Set("Location", url)
+	h.status = status
+	h.redirected = true
+	return nil
+}
+
+// noContent implements the NoContent binding.
+func (h *hook) noContent() error {
+	if !h.isSync {
+		return ErrSyncNeeded
+	}
+	if h.body.Len() > 0 || h.streamed || h.redirected || h.download != "" {
+		return ErrBodyWritten
+	}
+	if err := h.allowStatus(http.StatusNoContent); err != nil {
+		return err
+	}
+	h.status = http.StatusNoContent
+	h.empty = true
+	return nil
+}
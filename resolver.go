@@ -0,0 +1,69 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// NameResolver maps a request to the script to run, along with params
+// taken from the request, e.g. from the host or a header. An empty name
+// answers 404, as does one escaping the script path with "..". Names
+// are cleaned like paths. Aliases and allowed scripts still apply to the name.
+type NameResolver interface {
+	Resolve(r *http.Request) (string, Params, error)
+}
+
+// NameResolverFunc is an ordinary func used as a NameResolver.
+type NameResolverFunc func(r *http.Request) (string, Params, error)
+
+func (f NameResolverFunc) Resolve(r *http.Request) (string, Params, error) {
+	return f(r)
+}
+
+// SetNameResolver routes hook requests with nr instead of the path under
+// the base path. Nil restores the default.
+func (h *Handler) SetNameResolver(nr NameResolver) {
+	h.resolver = nr
+}
+
+// resolve returns the script of r and the params of the resolver.
+func (h *Handler) resolve(r *http.Request) (string, Params, error) {
+	if h.resolver == nil {
+		name, ok := h.scriptName(r.URL.Path)
+		if !ok {
+			return "", nil, ErrNotFound
+		}
+		return name, nil, nil
+	}
+	name, params, err := h.resolver.Resolve(r)
+	if err != nil {
+		return "", nil, err
+	}
+	name, ok := cleanName(name)
+	if !ok {
+		return "", nil, ErrNotFound
+	}
+	if name, ok := h.resolvedName(name); ok {
+		return name, params, nil
+	}
+	return "", nil, ErrNotFound
+}
+
+// cleanName cleans the script name of a resolver, relative to the
+// script path. It is not ok if the name is empty or escapes it.
+func cleanName(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
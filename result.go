@@ -0,0 +1,95 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"time"
+
+	"github.com/stevedonovan/luar"
+)
+
+// result is what an execution left behind, kept for later lookups.
+type result struct {
+	name   string
+	status int
+	body   string
+	err    string
+	done   time.Time
+}
+
+// SetResultStore keeps the results of the last size executions for ttl,
+// so scripts can look them up by id with ghoko.Result.Get. Zero size
+// turns it off, which is the default.
+func (h *Handler) SetResultStore(size int, ttl time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if size <= 0 {
+		h.results = nil
+		return
+	}
+	h.results = newCache(size)
+	h.resultTTL = ttl
+}
+
+func (h *Handler) resultStore() (*cache, time.Duration) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.results, h.resultTTL
+}
+
+const resultIdHeader = "Ghoko-Result-Id"
+
+// resultKey returns the id the result of the hook is stored under. It
+// is generated rather than taken from the request id, which clients may
+// choose, so they can not overwrite or guess the results of others.
+func (h *hook) resultKey() string {
+	if h.resultId == "" {
+		h.resultId = h.handler.idgen.Id().(string)
+	}
+	return h.resultId
+}
+
+// setResultId tells the client the result id, if results are stored.
+func (h *hook) setResultId() {
+	if results, _ := h.handler.resultStore(); results != nil {
+		h.w.Header().Set(resultIdHeader, h.resultKey())
+	}
+}
+
+// storeResult records the result of the execution of hk.
+func (h *Handler) storeResult(hk *hook, status int, body []byte, err error) {
+	results, ttl := h.resultStore()
+	if results == nil {
+		return
+	}
+	res := &result{name: hk.name, status: status, body: string(body), done: time.Now()}
+	if err != nil {
+		res.err = err.Error()
+	}
+	results.set(hk.resultKey(), res, ttl.Seconds())
+}
+
+func (h *Handler) resultBinding() luar.Map {
+	return luar.Map{
+		"Get": func(id string) interface{} {
+			results, _ := h.resultStore()
+			if results == nil {
+				return nil
+			}
+			res, ok := results.get(id).(*result)
+			if !ok {
+				return nil
+			}
+			return luar.Map{
+				"Name":   res.name,
+				"Status": res.status,
+				"Body":   res.body,
+				"Error":  res.err,
+				"Done":   res.done.Unix(),
+			}
+		},
+	}
+}
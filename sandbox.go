@@ -0,0 +1,77 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// SafeGlobals are the Lua globals kept by the sandbox. An entry `lib.fn`
+// keeps a single function of a library.
+var SafeGlobals = []string{
+	"_G", "_VERSION", "assert", "error", "getmetatable", "ipairs", "next",
+	"pairs", "pcall", "rawequal", "rawget", "rawset", "select",
+	"setmetatable", "tonumber", "tostring", "type", "unpack", "xpcall",
+	"coroutine", "math", "string", "table",
+	"os.clock", "os.date", "os.difftime", "os.time",
+	module, "luar",
+}
+
+// sandboxScript removes every global which is not allowed. Libraries
+// with some allowed functions are kept with those only.
+const sandboxScript = `
+local allow = {}
+for _, name in ipairs(%s) do
+	allow[name] = true
+end
+for k, v in pairs(_G) do
+	if not allow[k] then
+		local keep = false
+		if type(v) == "table" then
+			for fn in pairs(v) do
+				if allow[k .. "." .. fn] then
+					keep = true
+				else
+					v[fn] = nil
+				end
+			end
+		end
+		if not keep then
+			_G[k] = nil
+		end
+	end
+end
+`
+
+// sandboxer is implemented by interpreters able to restrict their
+// standard library.
+type sandboxer interface {
+	Sandbox(allowed []string) error
+}
+
+// SetSandbox restricts the Lua standard library of new interpreters to
+// SafeGlobals plus extra, so untrusted scripts can not read arbitrary
+// files, spawn processes or load code except through ghoko's bindings.
+func (h *Handler) SetSandbox(enabled bool, extra ...string) {
+	h.sandbox = nil
+	if enabled {
+		h.sandbox = append(append([]string{}, SafeGlobals...), extra...)
+	}
+}
+
+func luaStrings(names []string) string {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(strconv.Quote(name))
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
@@ -0,0 +1,270 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is the subset of JSON Schema ghoko validates payloads with:
+// type, enum, properties, required, additionalProperties (boolean),
+// items, minItems, maxItems, minimum, maximum, minLength, maxLength and
+// pattern.
+type Schema struct {
+	Type                 interface{}        `json:"type"`
+	Enum                 []interface{}      `json:"enum"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Pattern              string             `json:"pattern"`
+
+	types   []string
+	pattern *regexp.Regexp
+}
+
+// ValidationError is a violation of a schema at Path, like
+// `$.commits[0].id`. Expected is what the schema wants there, if it
+// says in a word, e.g. "string" or ">= 1".
+type ValidationError struct {
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+	Expected string `json:"expected,omitempty"`
+}
+
+// InvalidPayload is the error of a request body violating the schema of
+// its script. It is answered with 400 and the violations as JSON.
+type InvalidPayload struct {
+	Id     string
+	Errors []ValidationError
+}
+
+func (e *InvalidPayload) Error() string {
+	lines := make([]string, len(e.Errors))
+	for i, v := range e.Errors {
+		lines[i] = v.String()
+	}
+	return "Invalid payload:\n" + strings.Join(lines, "\n")
+}
+
+// MarshalJSON encodes e like other JSON errors, with the request id and
+// the violations.
+func (e *InvalidPayload) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Status  int               `json:"status"`
+		Message string            `json:"message"`
+		Id      string            `json:"id,omitempty"`
+		Errors  []ValidationError `json:"errors"`
+	}{http.StatusBadRequest, "Invalid payload", e.Id, e.Errors})
+}
+
+func (e ValidationError) String() string {
+	return e.Path + ": " + e.Message
+}
+
+// ParseSchema parses a JSON encoded schema.
+func ParseSchema(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Schema) compile() error {
+	switch t := s.Type.(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("schema type %v is not a string", v)
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return fmt.Errorf("schema type %v is neither a string nor a list", t)
+	}
+	if s.Pattern != "" {
+		p, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = p
+	}
+	for _, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// Validate returns the violations of s by the decoded JSON value v.
+func (s *Schema) Validate(v interface{}) []ValidationError {
+	var errs []ValidationError
+	s.validate("$", v, &errs)
+	return errs
+}
+
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func (s *Schema) validate(path string, v interface{}, errs *[]ValidationError) {
+	fail := func(expected, format string, a ...interface{}) {
+		*errs = append(*errs, ValidationError{path, fmt.Sprintf(format, a...), expected})
+	}
+	if len(s.types) > 0 {
+		t := jsonType(v)
+		ok := false
+		for _, want := range s.types {
+			if want == t || (want == "number" && t == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			want := strings.Join(s.types, " or ")
+			fail(want, "expected %s, got %s", want, t)
+			return
+		}
+	}
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("one of the enum", "value is not one of the allowed values")
+		}
+	}
+	switch v := v.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail(fmt.Sprintf(">= %v", *s.Minimum), "expected at least %v, got %v", *s.Minimum, v)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail(fmt.Sprintf("<= %v", *s.Maximum), "expected at most %v, got %v", *s.Maximum, v)
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail(fmt.Sprintf(">= %d characters", *s.MinLength), "expected at least %d characters, got %d", *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail(fmt.Sprintf("<= %d characters", *s.MaxLength), "expected at most %d characters, got %d", *s.MaxLength, n)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail(s.Pattern, "does not match pattern %q", s.Pattern)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail(fmt.Sprintf(">= %d items", *s.MinItems), "expected at least %d items, got %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail(fmt.Sprintf("<= %d items", *s.MaxItems), "expected at most %d items, got %d", *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, k := range s.Required {
+			if _, ok := v[k]; !ok {
+				*errs = append(*errs, ValidationError{path + "." + k, "is required", ""})
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p, ok := s.Properties[k]
+			switch {
+			case ok:
+				p.validate(path+"."+k, v[k], errs)
+			case s.AdditionalProperties != nil && !*s.AdditionalProperties:
+				*errs = append(*errs, ValidationError{path + "." + k, "is not allowed", ""})
+			}
+		}
+	}
+}
+
+// SetSchema validates JSON bodies of requests to the script name
+// against a JSON encoded schema. Invalid payloads are rejected with 400
+// and the list of violations as JSON, before the script runs.
+func (h *Handler) SetSchema(name string, schema []byte) error {
+	s, err := ParseSchema(schema)
+	if err != nil {
+		return err
+	}
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.schema = s
+	})
+	return nil
+}
+
+// validate checks the JSON body data against the schema of the script
+// name, if it has one.
+func (h *Handler) validate(name string, data []byte) error {
+	s := h.lookup(name).schema
+	if s == nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	errs := s.Validate(v)
+	if len(errs) == 0 {
+		return nil
+	}
+	return &InvalidPayload{Errors: errs}
+}
@@ -0,0 +1,135 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import "time"
+
+// scriptOptions overrides the handler defaults for one script.
+type scriptOptions struct {
+	timeout      time.Duration
+	schema       *Schema
+	windows      []TimeWindow
+	windowError  *HttpError
+	maxBody      int64
+	contentTypes []string
+	syncMode     SyncMode
+	priority     int
+	streaming    bool
+	signSecrets  []string
+	noContent    bool
+	limiter      *bucket
+	logLevel     LogLevel
+}
+
+// updateOptions calls f with the overrides of name, creating them if
+// needed. f runs under the handler lock, so requests never see a half
+// made change, e.g. on reload.
+func (h *Handler) updateOptions(name string, f func(opts *scriptOptions)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	opts, ok := h.scripts[name]
+	if !ok {
+		opts = &scriptOptions{}
+		h.scripts[name] = opts
+	}
+	f(opts)
+}
+
+// lookup returns a copy of the overrides of name.
+func (h *Handler) lookup(name string) scriptOptions {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if opts, ok := h.scripts[name]; ok {
+		return *opts
+	}
+	return scriptOptions{}
+}
+
+// SetScriptTimeout aborts scripts running longer than d. Zero means no
+// timeout.
+func (h *Handler) SetScriptTimeout(d time.Duration) {
+	h.timeout = d
+}
+
+// SetTimeoutFor overrides the script timeout for the script name.
+func (h *Handler) SetTimeoutFor(name string, d time.Duration) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.timeout = d
+	})
+}
+
+// SetNoContentFor makes successful sync executions of the script name
+// which wrote no body respond with 204 instead of 200.
+func (h *Handler) SetNoContentFor(name string, noContent bool) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.noContent = noContent
+	})
+}
+
+// SetSlowThreshold logs executions taking longer than d at warning
+// level, with their duration. Zero turns it off.
+func (h *Handler) SetSlowThreshold(d time.Duration) {
+	h.slowThreshold = d
+}
+
+func (h *Handler) scriptTimeout(name string) time.Duration {
+	if d := h.lookup(name).timeout; d != 0 {
+		return d
+	}
+	return h.timeout
+}
+
+// SyncMode decides whether requests to a script run sync or async.
+type SyncMode int
+
+const (
+	// SyncByClient follows the Ghoko-Sync header of the request.
+	SyncByClient SyncMode = iota
+	// SyncAlways runs every request sync.
+	SyncAlways
+	// SyncNever runs every request async.
+	SyncNever
+)
+
+// SetSyncModeFor makes requests to the script name run sync or async
+// regardless of the Ghoko-Sync header.
+func (h *Handler) SetSyncModeFor(name string, mode SyncMode) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.syncMode = mode
+	})
+}
+
+// isSync reports whether a request to name asking for sync runs sync.
+func (h *Handler) isSync(name string, sync bool) bool {
+	switch h.lookup(name).syncMode {
+	case SyncAlways:
+		return true
+	case SyncNever:
+		return false
+	}
+	return sync
+}
+
+// SetAllowedScripts makes only the scripts names reachable by requests,
+// others get 404 even if their file exists. Nil allows all scripts.
+func (h *Handler) SetAllowedScripts(names []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if names == nil {
+		h.allowedScripts = nil
+		return
+	}
+	h.allowedScripts = make(map[string]bool, len(names))
+	for _, name := range names {
+		h.allowedScripts[name] = true
+	}
+}
+
+func (h *Handler) allowed(name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.allowedScripts == nil || h.allowedScripts[name]
+}
@@ -0,0 +1,107 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SecretLocations names where clients may pass the secret. An empty name
+// turns that location off.
+type SecretLocations struct {
+	// Query is the query param, "_secret" by default.
+	Query string
+	// Header is the request header.
+	Header string
+	// Body is the field of a JSON or form body. It is only looked at
+	// for hooks, other endpoints need the query param or the header.
+	Body string
+}
+
+// SetSecretLocations sets where the secret is looked for. Wherever it
+// was passed, it is removed before the script sees the params.
+func (h *Handler) SetSecretLocations(locs SecretLocations) {
+	h.secretLocs = locs
+}
+
+// currentSecret is the secret, which a reload may change.
+func (h *Handler) currentSecret() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.secret
+}
+
+func (h *Handler) isSecret(v string) bool {
+	return subtle.ConstantTimeCompare([]byte(v), []byte(h.currentSecret())) == 1
+}
+
+// authorized reports whether r passes the secret in the query or a
+// header.
+func (h *Handler) authorized(r *http.Request, u *url.URL) bool {
+	if h.currentSecret() == "" {
+		return true
+	}
+	locs := h.secretLocs
+	if locs.Query != "" && h.isSecret(u.Query().Get(locs.Query)) {
+		return true
+	}
+	return locs.Header != "" && h.isSecret(r.Header.Get(locs.Header))
+}
+
+// bodySecret reports whether the body of r holds the secret in the body
+// field. It runs before any other check, so requests without the secret
+// use up no limits. The body is put back for the hook to read.
+func (h *Handler) bodySecret(r *http.Request) bool {
+	field := h.secretLocs.Body
+	if field == "" || r.Body == nil || !nativeType(r) {
+		return false
+	}
+	var body io.Reader = r.Body
+	if h.maxBody > 0 {
+		body = io.LimitReader(r.Body, h.maxBody+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if err != nil || (h.maxBody > 0 && int64(len(data)) > h.maxBody) {
+		return false
+	}
+	if !strings.Contains(r.Header.Get("Content-Type"), "json") {
+		values, err := url.ParseQuery(string(data))
+		return err == nil && len(values[field]) == 1 && h.isSecret(values[field][0])
+	}
+	if data, err = h.decrypt(data); err != nil {
+		return false
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	v, ok := fields[field].(string)
+	return ok && h.isSecret(v)
+}
+
+// stripSecret removes the secret from everything the script can see.
+func (h *hook) stripSecret() {
+	locs := h.handler.secretLocs
+	if locs.Query != "" {
+		delete(h.params, locs.Query)
+	}
+	if locs.Body != "" {
+		h.loadParams()
+		delete(h.params, locs.Body)
+	}
+	if locs.Header != "" {
+		h.r.Header.Del(locs.Header)
+	}
+}
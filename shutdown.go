@@ -0,0 +1,90 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"time"
+
+	"github.com/mikespook/golib/log"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// SetStartupScript runs the script name from Start, e.g. to register the
+// instance with service discovery.
+func (h *Handler) SetStartupScript(name string) {
+	h.startupScript = name
+}
+
+// Start runs the startup script. It is meant to be called once before
+// serving, and its error is left to the caller to decide on.
+func (h *Handler) Start() error {
+	name := h.startupScript
+	if name == "" {
+		return nil
+	}
+	id, err := h.runInternal(name, 0)
+	if err != nil {
+		log.Errorf("%s Startup script %q: %s", id, name, err)
+		return err
+	}
+	log.Messagef("%s Startup script %q done", id, name)
+	return nil
+}
+
+// SetShutdownScript runs the script name when the handler is closed,
+// e.g. to announce the instance is going offline.
+func (h *Handler) SetShutdownScript(name string) {
+	h.shutdownScript = name
+}
+
+// Close runs the shutdown script, then frees the interpreters once the
+// executions in flight are done. The shutdown script is given at most
+// 10 seconds and its failure does not stop Close. Executions in flight
+// are given 10 seconds too, then Close frees the idle interpreters and
+// returns ErrDrainTimeout, leaving the busy ones to the process exit.
+func (h *Handler) Close() error {
+	if name := h.shutdownScript; name != "" {
+		if id, err := h.runInternal(name, shutdownTimeout); err != nil {
+			log.Errorf("%s Shutdown script %q: %s", id, name, err)
+		} else {
+			log.Messagef("%s Shutdown script %q done", id, name)
+		}
+	}
+	h.SetIdleTimeout(0)
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	// No interpreter is taken from the pool once closed is set, so
+	// waiting for the ones in use can not race with getIpt.
+	h.closed = true
+	gen := h.gen
+	h.mu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		gen.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(shutdownTimeout):
+		gen.free()
+		log.Errorf("Executions still running after %s", shutdownTimeout)
+		return ErrDrainTimeout
+	}
+	gen.free()
+	h.closeDatabase()
+	h.closeBackends()
+	if h.access != nil {
+		h.access.close()
+	}
+	if h.recorder != nil {
+		h.recorder.close()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SetSignatureSecrets requires requests to carry a Ghoko-Signature
+// header, the hex HMAC-SHA256 of the body under one of secrets. Several
+// secrets allow rotating them without downtime. No secrets turns it off.
+func (h *Handler) SetSignatureSecrets(secrets ...string) {
+	h.signSecrets = secrets
+}
+
+// SetSignatureSecretsFor overrides the signature secrets for the script
+// name.
+func (h *Handler) SetSignatureSecretsFor(name string, secrets ...string) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.signSecrets = secrets
+	})
+}
+
+// SetSignatureTolerance requires signed requests to carry a
+// Ghoko-Timestamp header with unix seconds no further than d from now.
+// The signature is then over "timestamp.body" so it can not be replayed
+// later. Zero does not require a timestamp.
+func (h *Handler) SetSignatureTolerance(d time.Duration) {
+	h.signTolerance = d
+}
+
+// SetSignatureCanonical makes signatures, checked and sent, be over the
+// canonical form of JSON bodies, see Canonicalize, instead of their
+// exact bytes. Bodies which are not JSON are signed as they are.
+func (h *Handler) SetSignatureCanonical(canonical bool) {
+	h.signCanonical = canonical
+}
+
+// signedBody is the part of body signatures are over.
+func (h *Handler) signedBody(body []byte) []byte {
+	if !h.signCanonical {
+		return body
+	}
+	if c, err := Canonicalize(body); err == nil {
+		return c
+	}
+	return body
+}
+
+// SetRemoteSecret signs the requests of Get, Post and PostJSON with a
+// Ghoko-Signature under secret, as another ghoko verifies them. With
+// timestamped, they carry a Ghoko-Timestamp too, for remotes with a
+// signature tolerance. An empty secret does not sign.
+func (h *Handler) SetRemoteSecret(secret string, timestamped bool) {
+	h.remoteSecret, h.remoteTimestamp = secret, timestamped
+}
+
+// sign sets the signature headers of an outbound request.
+func (h *Handler) sign(req *http.Request) error {
+	var body []byte
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if body, err = ioutil.ReadAll(rc); err != nil {
+			return err
+		}
+	}
+	body = h.signedBody(body)
+	if h.remoteTimestamp {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Ghoko-Timestamp", ts)
+		body = append([]byte(ts+"."), body...)
+	}
+	mac := hmac.New(sha256.New, []byte(h.remoteSecret))
+	mac.Write(body)
+	req.Header.Set("Ghoko-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// verify checks the signature of r for the script name. The body is
+// read and put back for the hook.
+func (h *Handler) verify(name string, r *http.Request) error {
+	secrets := h.signSecrets
+	if s := h.lookup(name).signSecrets; s != nil {
+		secrets = s
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return badRequest(err)
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sig, err := hex.DecodeString(r.Header.Get("Ghoko-Signature"))
+	if err != nil || len(sig) == 0 {
+		return ErrBadSignature
+	}
+	signed := h.signedBody(body)
+	if h.signTolerance > 0 {
+		ts := r.Header.Get("Ghoko-Timestamp")
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return ErrBadSignature
+		}
+		if d := time.Since(time.Unix(sec, 0)); d > h.signTolerance || d < -h.signTolerance {
+			return ErrStaleSignature
+		}
+		signed = append([]byte(ts+"."), signed...)
+	}
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
@@ -0,0 +1,61 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+	"path"
+)
+
+// SlashPolicy decides how paths with trailing, duplicate or dot
+// segments, like `//deploy//`, are handled.
+type SlashPolicy int
+
+const (
+	// SlashRewrite serves the cleaned path directly.
+	SlashRewrite SlashPolicy = iota
+	// SlashRedirect redirects the client to the cleaned path, with 301
+	// for GET and HEAD and 308 for other methods so the body is resent.
+	SlashRedirect
+)
+
+// SetSlashPolicy sets how unclean paths are handled. The default is
+// SlashRewrite.
+func (h *Handler) SetSlashPolicy(policy SlashPolicy) {
+	h.slashPolicy = policy
+}
+
+func cleanPath(p string) string {
+	return path.Clean(path.Join("/", p))
+}
+
+// normalize cleans the path of r. It returns false when the client was
+// redirected instead.
+func (h *Handler) normalize(w http.ResponseWriter, r *http.Request) bool {
+	p := cleanPath(r.URL.Path)
+	if p == r.URL.Path {
+		return true
+	}
+	if h.slashPolicy == SlashRedirect {
+		h.redirect(w, r, p)
+		return false
+	}
+	r.URL.Path = p
+	return true
+}
+
+// redirect sends the client to p, keeping the query. Methods other than
+// GET and HEAD get 308 so that the body is sent again.
+func (h *Handler) redirect(w http.ResponseWriter, r *http.Request, p string) {
+	u := *r.URL
+	u.Path = p
+	status := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		status = http.StatusPermanentRedirect
+	}
+	w.Header().Set("Location", u.RequestURI())
+	h.writeAndLog(w, r, status, nil)
+}
@@ -0,0 +1,107 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/stevedonovan/luar"
+)
+
+type stats struct {
+	requests     int64
+	errors       int64
+	created      int64
+	inUse        int64
+	initFailures int64
+}
+
+type poolStatus struct {
+	Created      int64 `json:"created"`
+	InUse        int64 `json:"in_use"`
+	InitFailures int64 `json:"init_failures"`
+}
+
+type requestStatus struct {
+	Total    int64            `json:"total"`
+	Errors   int64            `json:"errors"`
+	Outcomes map[string]int64 `json:"outcomes"`
+}
+
+type serverStatus struct {
+	Ready     bool                   `json:"ready"`
+	Version   string                 `json:"version"`
+	StartTime time.Time              `json:"start_time"`
+	Uptime    float64                `json:"uptime"`
+	Pool      poolStatus             `json:"pool"`
+	Requests  requestStatus          `json:"requests"`
+	Timers    map[string]timerStatus `json:"timers"`
+	Sizes     map[string]timerStatus `json:"sizes"`
+}
+
+// SetStatusPath moves the status endpoint to p. An empty p disables it.
+func (h *Handler) SetStatusPath(p string) {
+	if h.statusPath != "" {
+		delete(h.routes, h.statusPath)
+	}
+	h.statusPath = p
+	if p != "" {
+		h.routes[p] = h.serveStatus
+	}
+}
+
+func (h *Handler) uptime() float64 {
+	return time.Since(h.startTime).Seconds()
+}
+
+func (h *Handler) serverBinding(worker int64) luar.Map {
+	return luar.Map{
+		"WorkerId":  worker,
+		"Version":   Version,
+		"Commit":    Commit,
+		"BuildDate": BuildDate,
+		"GoVersion": runtime.Version(),
+		"Profile":   h.Profile(),
+		"StartTime": h.startTime.Unix(),
+	}
+}
+
+func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	failures := atomic.LoadInt64(&h.stats.initFailures)
+	ready := h.initPolicy != InitUnavailable || failures == 0
+	data, err := json.Marshal(serverStatus{
+		Ready:     ready,
+		Version:   Version,
+		StartTime: h.startTime,
+		Uptime:    h.uptime(),
+		Pool: poolStatus{
+			Created:      atomic.LoadInt64(&h.stats.created),
+			InUse:        atomic.LoadInt64(&h.stats.inUse),
+			InitFailures: failures,
+		},
+		Requests: requestStatus{
+			Total:    atomic.LoadInt64(&h.stats.requests),
+			Errors:   atomic.LoadInt64(&h.stats.errors),
+			Outcomes: h.outcomes.snapshot(),
+		},
+		Timers: h.timers.snapshot(),
+		Sizes:  h.sizes.snapshot(),
+	})
+	if err != nil {
+		h.writeAndLogError(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.writeAndLog(w, r, status, data)
+}
@@ -0,0 +1,64 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import "net/http"
+
+// SetStreamingFor makes WriteBody of the script name send its data to
+// the client right away instead of buffering the whole response. The
+// status and headers are sent with the first write, so a failure after
+// it can not change the status anymore.
+func (h *Handler) SetStreamingFor(name string, streaming bool) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.streaming = streaming
+	})
+}
+
+// writeBody implements the WriteBody binding.
+func (h *hook) writeBody(str string) error {
+	if !h.isSync {
+		return ErrSyncNeeded
+	}
+	if h.redirected {
+		return ErrRedirected
+	}
+	if h.download != "" || h.empty {
+		return ErrBodyWritten
+	}
+	if h.writeErr != nil {
+		return h.writeErr
+	}
+	if max := h.handler.maxResponse; max > 0 && h.written+int64(len(str)) > max {
+		h.failure = ErrResponseTooLarge
+		return ErrResponseTooLarge
+	}
+	h.written += int64(len(str))
+	h.handler.logBody(h.id, "response", []byte(str))
+	if !h.streaming {
+		_, err := h.body.WriteString(str)
+		return err
+	}
+	if !h.streamed {
+		h.w.WriteHeader(h.status)
+		h.streamed = true
+	}
+	if h.r.Method == http.MethodHead {
+		return nil
+	}
+	if _, err := h.w.Write([]byte(str)); err != nil {
+		// The connection is broken, so stop writing and let the script
+		// and bindings see it through the context.
+		h.writeErr = err
+		if h.cancel != nil {
+			h.cancel()
+		}
+		return err
+	}
+	if f, ok := h.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
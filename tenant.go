@@ -0,0 +1,72 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// tenant is the handler and TLS config of one host.
+type tenant struct {
+	handler *Handler
+	tls     *tls.Config
+}
+
+// Tenants serves several handlers, each with its own script root and
+// secret, on one listener, picking them by the TLS server name (SNI) or
+// else by the Host header.
+type Tenants struct {
+	mu    sync.RWMutex
+	hosts map[string]tenant
+}
+
+func NewTenants() *Tenants {
+	return &Tenants{hosts: make(map[string]tenant)}
+}
+
+// Add serves host with h. cfg, if not nil, is the TLS config of the host,
+// e.g. with its certificate; otherwise the one of the server is used.
+func (t *Tenants) Add(host string, h *Handler, cfg *tls.Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hosts[strings.ToLower(host)] = tenant{h, cfg}
+}
+
+func (t *Tenants) lookup(host string) (tenant, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tn, ok := t.hosts[strings.ToLower(host)]
+	return tn, ok
+}
+
+// GetConfigForClient is meant for tls.Config.GetConfigForClient, so
+// every host gets its TLS config.
+func (t *Tenants) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if tn, ok := t.lookup(hello.ServerName); ok {
+		return tn.tls, nil
+	}
+	return nil, nil
+}
+
+// ServeHTTP passes r to the handler of its host, 404 for unknown ones.
+func (t *Tenants) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		host = r.TLS.ServerName
+	} else if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tn, ok := t.lookup(host)
+	if !ok {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	tn.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,62 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"time"
+
+	"github.com/stevedonovan/luar"
+)
+
+// SetTimezone sets the default location used by the Time binding.
+func (h *Handler) SetTimezone(name string) error {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	h.location = loc
+	return nil
+}
+
+func (h *Handler) zone(tz []string) (*time.Location, error) {
+	if len(tz) == 0 || tz[0] == "" {
+		return h.location, nil
+	}
+	return time.LoadLocation(tz[0])
+}
+
+func (h *Handler) timeBinding() luar.Map {
+	return luar.Map{
+		"Now": func(tz ...string) (string, error) {
+			loc, err := h.zone(tz)
+			if err != nil {
+				return "", err
+			}
+			return time.Now().In(loc).Format(time.RFC3339), nil
+		},
+		"Unix": func() int64 {
+			return time.Now().Unix()
+		},
+		"Format": func(unix int64, layout string, tz ...string) (string, error) {
+			loc, err := h.zone(tz)
+			if err != nil {
+				return "", err
+			}
+			return time.Unix(unix, 0).In(loc).Format(layout), nil
+		},
+		"Parse": func(layout, value string, tz ...string) (int64, error) {
+			loc, err := h.zone(tz)
+			if err != nil {
+				return 0, err
+			}
+			t, err := time.ParseInLocation(layout, value, loc)
+			if err != nil {
+				return 0, err
+			}
+			return t.Unix(), nil
+		},
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stevedonovan/luar"
+)
+
+// maxTimers bounds the distinct script sections timed, later ones are
+// dropped.
+const maxTimers = 256
+
+// timerBuckets are the upper bounds in seconds of the histogram buckets.
+var timerBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// sizeBuckets are the upper bounds in bytes of the size histograms.
+var sizeBuckets = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+// timerStatus is a histogram of the durations of one script section.
+// Buckets are cumulative, like Prometheus histograms.
+type timerStatus struct {
+	Count   int64            `json:"count"`
+	Sum     float64          `json:"sum"`
+	Max     float64          `json:"max"`
+	Buckets map[string]int64 `json:"buckets"`
+	counts  []int64
+}
+
+// timers keeps a histogram per key, with buckets of timerBuckets unless
+// others are set.
+type timers struct {
+	sync.Mutex
+	buckets  []float64
+	sections map[string]*timerStatus
+}
+
+func (t *timers) bounds() []float64 {
+	if t.buckets == nil {
+		return timerBuckets
+	}
+	return t.buckets
+}
+
+func (t *timers) observe(key string, v float64) {
+	t.Lock()
+	defer t.Unlock()
+	s, ok := t.sections[key]
+	if !ok {
+		if len(t.sections) >= maxTimers {
+			return
+		}
+		s = &timerStatus{counts: make([]int64, len(t.bounds()))}
+		t.sections[key] = s
+	}
+	s.Count++
+	s.Sum += v
+	if v > s.Max {
+		s.Max = v
+	}
+	for i, le := range t.bounds() {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+}
+
+func (t *timers) snapshot() map[string]timerStatus {
+	t.Lock()
+	defer t.Unlock()
+	sections := make(map[string]timerStatus, len(t.sections))
+	for key, s := range t.sections {
+		buckets := make(map[string]int64, len(t.bounds())+1)
+		for i, le := range t.bounds() {
+			buckets[strconv.FormatFloat(le, 'g', -1, 64)] = s.counts[i]
+		}
+		buckets["+Inf"] = s.Count
+		sections[key] = timerStatus{Count: s.Count, Sum: s.Sum, Max: s.Max, Buckets: buckets}
+	}
+	return sections
+}
+
+// timerBinding times sections of the script, labeled "script:section".
+func (h *hook) timerBinding() luar.Map {
+	return luar.Map{
+		"Start": func(section string) luar.Map {
+			start := time.Now()
+			var once sync.Once
+			return luar.Map{
+				"Stop": func() float64 {
+					d := time.Since(start)
+					once.Do(func() {
+						h.handler.timers.observe(h.name+":"+section, d.Seconds())
+					})
+					return d.Seconds()
+				},
+			}
+		},
+	}
+}
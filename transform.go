@@ -0,0 +1,126 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/mikespook/golib/iptpool"
+	"github.com/stevedonovan/luar"
+)
+
+// Transform is a step rewriting the params of a request before its
+// script runs, see SetTransforms.
+type Transform struct {
+	fn     func(p Params) error
+	script string
+}
+
+// TransformFunc makes a step of f.
+func TransformFunc(f func(p Params) error) Transform {
+	return Transform{fn: f}
+}
+
+// TransformScript runs the script name as a step. It sees the params as
+// ghoko.Params and changes them with ghoko.SetParam.
+func TransformScript(name string) Transform {
+	return Transform{script: name}
+}
+
+// LowerKeys lower cases the top level param names.
+func LowerKeys() Transform {
+	return TransformFunc(func(p Params) error {
+		for k, v := range p {
+			if l := strings.ToLower(k); l != k {
+				delete(p, k)
+				p[l] = v
+			}
+		}
+		return nil
+	})
+}
+
+// DecodeBase64 decodes the string param field in place. A missing
+// field is left alone.
+func DecodeBase64(field string) Transform {
+	return TransformFunc(func(p Params) error {
+		s, ok := p[field].(string)
+		if !ok {
+			return nil
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		p[field] = string(data)
+		return nil
+	})
+}
+
+// Flatten replaces nested objects by their leaves, the names joined by
+// sep, e.g. {"repo": {"name": "x"}} becomes {"repo.name": "x"}.
+func Flatten(sep string) Transform {
+	return TransformFunc(func(p Params) error {
+		for k, v := range p {
+			if m, ok := object(v); ok {
+				delete(p, k)
+				flatten(p, k, sep, m)
+			}
+		}
+		return nil
+	})
+}
+
+func object(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case luar.Map:
+		return v, true
+	}
+	return nil, false
+}
+
+func flatten(p Params, prefix, sep string, m map[string]interface{}) {
+	for k, v := range m {
+		if sub, ok := object(v); ok {
+			flatten(p, prefix+sep+k, sep, sub)
+		} else {
+			p[prefix+sep+k] = v
+		}
+	}
+}
+
+// SetTransforms applies steps in order to the params of every request
+// before its script runs, so scripts share the same preprocessing. A
+// failing step fails the request, with 400 for Go steps.
+func (h *Handler) SetTransforms(steps ...Transform) {
+	h.transforms = steps
+}
+
+// transform applies the transforms of the handler to the hook params.
+func (h *hook) transform(ipt iptpool.ScriptIpt) (int, error) {
+	if len(h.handler.transforms) == 0 {
+		return http.StatusOK, nil
+	}
+	if err := h.loadParams(); err != nil {
+		return StatusCode(err), err
+	}
+	for _, t := range h.handler.transforms {
+		if t.script == "" {
+			if err := t.fn(h.params); err != nil {
+				return http.StatusBadRequest, badRequest(err)
+			}
+			continue
+		}
+		if err := ipt.Exec(t.script, h.params); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return http.StatusOK, nil
+}
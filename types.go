@@ -6,9 +6,13 @@
 package ghoko
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/stevedonovan/luar"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
 type Params luar.Map
@@ -19,17 +23,135 @@ func (p Params) AddValues(values url.Values) {
 	}
 }
 
-func (p Params) AddJSON(data []byte) (err error) {
+// JSONOptions controls how AddJSONOptions decodes a JSON body.
+// Zero values mean no limit.
+type JSONOptions struct {
+	// MaxParams caps the number of keys and array elements at all levels.
+	MaxParams int
+	// MaxDepth caps the nesting depth of objects and arrays.
+	MaxDepth int
+	// UseNumber keeps numbers as their literal strings instead of
+	// float64, so large ids do not lose precision.
+	UseNumber bool
+	// DeepMerge merges nested objects into existing ones recursively
+	// instead of replacing top-level keys wholesale.
+	DeepMerge bool
+}
+
+// within reports whether v, an object or array at depth, and its
+// children stay within opts. Scalars do not add to the depth.
+func (opts JSONOptions) within(v interface{}, depth int, n *int) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		if opts.MaxDepth > 0 && depth > opts.MaxDepth {
+			return false
+		}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, item := range v {
+			if !opts.count(n) || !opts.within(item, depth+1, n) {
+				return false
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if !opts.count(n) || !opts.within(item, depth+1, n) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (opts JSONOptions) count(n *int) bool {
+	*n++
+	return opts.MaxParams <= 0 || *n <= opts.MaxParams
+}
+
+func numberToString(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		return v.String()
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = numberToString(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = numberToString(item)
+		}
+	}
+	return v
+}
+
+func (p Params) AddJSON(data []byte) error {
+	return p.AddJSONOptions(data, JSONOptions{})
+}
+
+func (p Params) AddJSONOptions(data []byte, opts JSONOptions) (err error) {
 	var tmp luar.Map
-	if err = json.Unmarshal(data, &tmp); err != nil {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if opts.UseNumber {
+		dec.UseNumber()
+	}
+	if err = dec.Decode(&tmp); err != nil {
 		return
 	}
+	if opts.UseNumber {
+		for k, v := range tmp {
+			tmp[k] = numberToString(v)
+		}
+	}
+	if opts.MaxParams > 0 || opts.MaxDepth > 0 {
+		var n int
+		if !opts.within(map[string]interface{}(tmp), 1, &n) {
+			return ErrParamsLimit
+		}
+	}
 	for k, v := range tmp {
+		if opts.DeepMerge {
+			v = merge(p[k], v)
+		}
 		p[k] = v
 	}
 	return
 }
 
+// merge merges src into a copy of dst if both are objects, otherwise
+// src wins. dst is left as is, since it may belong to a resolver.
+func merge(dst, src interface{}) interface{} {
+	d, ok := asMap(dst)
+	if !ok {
+		return src
+	}
+	s, ok := asMap(src)
+	if !ok {
+		return src
+	}
+	m := make(map[string]interface{}, len(d)+len(s))
+	for k, v := range d {
+		m[k] = v
+	}
+	for k, v := range s {
+		m[k] = merge(d[k], v)
+	}
+	return m
+}
+
+// asMap returns v as a plain map if it is an object.
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case luar.Map:
+		return v, true
+	case Params:
+		return v, true
+	}
+	return nil, false
+}
+
 func (p Params) Values() url.Values {
 	values := make(url.Values)
 	for k, v := range p {
@@ -42,3 +164,185 @@ func (p Params) Values() url.Values {
 	}
 	return values
 }
+
+// paramLen returns the number of elements of an array or the number of
+// keys of an object.
+func paramLen(v interface{}) int {
+	switch v := v.(type) {
+	case []interface{}:
+		return len(v)
+	case []string:
+		return len(v)
+	case map[string]interface{}:
+		return len(v)
+	case luar.Map:
+		return len(v)
+	}
+	return 0
+}
+
+// paramSlice returns the elements i to j of an array, 1-based and
+// inclusive like string.sub.
+func paramSlice(v interface{}, i, j int) []interface{} {
+	var items []interface{}
+	switch v := v.(type) {
+	case []interface{}:
+		items = v
+	case []string:
+		items = make([]interface{}, len(v))
+		for k, s := range v {
+			items[k] = s
+		}
+	default:
+		return nil
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > len(items) {
+		j = len(items)
+	}
+	if i > j {
+		return []interface{}{}
+	}
+	return items[i-1 : j]
+}
+
+// paramPath follows expr, like "repository.owner.login" or
+// "commits[0].id", through nested objects and arrays of v. Indexes are
+// 0-based as in JSON. It returns nil if any segment is missing.
+func paramPath(v interface{}, expr string) interface{} {
+	for _, seg := range strings.Split(expr, ".") {
+		key := seg
+		var idx []string
+		if i := strings.IndexByte(seg, '['); i >= 0 {
+			key = seg[:i]
+			for _, s := range strings.Split(seg[i+1:], "[") {
+				if !strings.HasSuffix(s, "]") {
+					return nil
+				}
+				idx = append(idx, strings.TrimSuffix(s, "]"))
+			}
+		}
+		if key != "" {
+			if v = paramKey(v, key); v == nil {
+				return nil
+			}
+		}
+		for _, s := range idx {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return nil
+			}
+			if v = paramIndex(v, n); v == nil {
+				return nil
+			}
+		}
+	}
+	return v
+}
+
+func paramKey(v interface{}, key string) interface{} {
+	switch v := v.(type) {
+	case Params:
+		return v[key]
+	case luar.Map:
+		return v[key]
+	case map[string]interface{}:
+		return v[key]
+	}
+	return nil
+}
+
+func paramIndex(v interface{}, n int) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		if n >= 0 && n < len(v) {
+			return v[n]
+		}
+	case []string:
+		if n >= 0 && n < len(v) {
+			return v[n]
+		}
+	}
+	return nil
+}
+
+// toQuery encodes params as a query string with sorted keys. Arrays
+// repeat the key and nested objects use `key[sub]` names.
+func toQuery(v interface{}) string {
+	values := make(url.Values)
+	addQuery(values, "", v)
+	return values.Encode()
+}
+
+func addQuery(values url.Values, key string, v interface{}) {
+	sub := func(k string) string {
+		if key == "" {
+			return k
+		}
+		return key + "[" + k + "]"
+	}
+	switch v := v.(type) {
+	case Params:
+		for k, e := range v {
+			addQuery(values, sub(k), e)
+		}
+	case luar.Map:
+		for k, e := range v {
+			addQuery(values, sub(k), e)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			addQuery(values, sub(k), e)
+		}
+	case []interface{}:
+		for _, e := range v {
+			addQuery(values, key, e)
+		}
+	case []string:
+		for _, e := range v {
+			values.Add(key, e)
+		}
+	case nil:
+	default:
+		if key != "" {
+			values.Add(key, fmt.Sprint(v))
+		}
+	}
+}
+
+// toJSON encodes params as JSON. Object keys are sorted.
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// Canonicalize re-encodes JSON deterministically: object keys sorted,
+// no whitespace, numbers as written and no HTML escaping, so the same
+// document always gives the same bytes to sign.
+func Canonicalize(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// jsonBinding is ghoko.Json.
+func jsonBinding() luar.Map {
+	return luar.Map{
+		"Canonical": func(s string) (string, error) {
+			data, err := Canonicalize([]byte(s))
+			return string(data), err
+		},
+	}
+}
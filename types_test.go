@@ -0,0 +1,49 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeepMergeIntoResolverParams(t *testing.T) {
+	defaults := map[string]interface{}{"channel": "#ops", "retries": 3.0}
+	for _, deepMerge := range []bool{false, true} {
+		h := New(".", "", "/")
+		h.SetDeepMerge(deepMerge)
+		h.SetNameResolver(NameResolverFunc(func(r *http.Request) (string, Params, error) {
+			return "notify", Params{"config": defaults}, nil
+		}))
+		body := `{"config": {"retries": 5}}`
+		r := httptest.NewRequest("POST", "/notify?env=prod", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		hk, err := newHook(h, httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hk.loadParams(); err != nil {
+			t.Fatal(err)
+		}
+		// Without deep merge the resolver params override the body.
+		want := defaults
+		if deepMerge {
+			want = map[string]interface{}{"channel": "#ops", "retries": 5.0}
+		}
+		if got := hk.params["config"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("deepMerge=%t: config = %v, want %v", deepMerge, got, want)
+		}
+		if got := hk.params["env"]; !reflect.DeepEqual(got, []string{"prod"}) {
+			t.Errorf("deepMerge=%t: env = %v, want [prod]", deepMerge, got)
+		}
+	}
+	if defaults["retries"] != 3.0 {
+		t.Errorf("resolver params were modified: %v", defaults)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X github.com/mikespook/ghoko.Commit=$(git rev-parse HEAD)"
+var (
+	Version   = "0.2.0"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildInfo() versionInfo {
+	return versionInfo{Version, Commit, BuildDate, runtime.Version()}
+}
+
+// serveVersion does not need the secret, so monitoring can tell which
+// build is deployed.
+func (h *Handler) serveVersion(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(buildInfo())
+	if err != nil {
+		h.writeAndLogError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.writeAndLog(w, r, http.StatusOK, data)
+}
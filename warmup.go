@@ -0,0 +1,113 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const defaultMaxWarmup = 32
+
+// compiler is implemented by interpreters able to check a script
+// compiles without running it.
+type compiler interface {
+	Compile(name string) error
+}
+
+// warmupStatus is the summary answered by /admin/warmup.
+type warmupStatus struct {
+	Interpreters int               `json:"interpreters"`
+	Scripts      map[string]string `json:"scripts"`
+}
+
+// SetWarmupScripts sets the scripts /admin/warmup compiles.
+func (h *Handler) SetWarmupScripts(names ...string) {
+	h.warmupScripts = names
+}
+
+// SetMaxWarmup caps the `n` /admin/warmup accepts, bigger ones get 400.
+// Zero keeps the default of 32.
+func (h *Handler) SetMaxWarmup(n int) {
+	h.maxWarmup = n
+}
+
+// Warmup creates interpreters until the pool has n, then compiles the
+// warmup scripts, so their files are read and broken ones show up
+// before traffic comes in. It returns the errors by script.
+func (h *Handler) Warmup(n int) (int, map[string]error) {
+	errs := make(map[string]error, len(h.warmupScripts))
+	h.mu.RLock()
+	if h.closed {
+		h.mu.RUnlock()
+		for _, name := range h.warmupScripts {
+			errs[name] = ErrClosed
+		}
+		return 0, errs
+	}
+	gen := h.gen
+	gen.wg.Add(1)
+	h.mu.RUnlock()
+	gen.warm(h, n)
+	gen.wg.Done()
+	gen.mu.Lock()
+	live := gen.live
+	gen.mu.Unlock()
+	if len(h.warmupScripts) == 0 {
+		return live, errs
+	}
+	ipt, err := h.getIpt()
+	if err != nil {
+		for _, name := range h.warmupScripts {
+			errs[name] = err
+		}
+		return live, errs
+	}
+	defer h.putIpt(ipt)
+	c, ok := ipt.ScriptIpt.(compiler)
+	for _, name := range h.warmupScripts {
+		if ok {
+			errs[name] = c.Compile(name)
+		} else {
+			errs[name] = nil
+		}
+	}
+	return live, errs
+}
+
+// serveWarmup warms the pool with the `n` parameter, 1 by default and
+// at most maxWarmup, and reports "ok" or the compile error of every warmup script.
+func (h *Handler) serveWarmup(w http.ResponseWriter, r *http.Request) {
+	n, max := 1, h.maxWarmup
+	if max == 0 {
+		max = defaultMaxWarmup
+	}
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 || n > max {
+			h.writeAndLogError(w, r, ErrBadRequest)
+			return
+		}
+	}
+	live, errs := h.Warmup(n)
+	status := warmupStatus{Interpreters: live, Scripts: make(map[string]string, len(errs))}
+	code := http.StatusOK
+	for name, err := range errs {
+		status.Scripts[name] = "ok"
+		if err != nil {
+			status.Scripts[name] = err.Error()
+			code = http.StatusInternalServerError
+		}
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		h.writeAndLogError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.writeAndLog(w, r, code, data)
+}
@@ -0,0 +1,91 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mikespook/golib/iptpool"
+	"github.com/stevedonovan/luar"
+	"golang.org/x/net/websocket"
+)
+
+// SetWebSocket upgrades requests to p into a WebSocket connection and
+// runs the script name for it. The script talks to the client through
+// ghoko.Ws.Send(msg) and ghoko.Ws.Recv(), and holds its interpreter for
+// the whole lifetime of the connection, which the script timeout bounds
+// like any other execution.
+func (h *Handler) SetWebSocket(p, name string) {
+	h.routes[p] = func(w http.ResponseWriter, r *http.Request) {
+		h.serveWebSocket(w, r, name)
+	}
+}
+
+// serveWebSocket admits the request like ServeHTTP does before
+// upgrading it, so refusals still get a plain HTTP answer.
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request, name string) {
+	if h.InMaintenance() {
+		h.writeAndLogError(w, r, ErrMaintenance)
+		return
+	}
+	atomic.AddInt64(&h.stats.requests, 1)
+	name, ok := h.resolvedName(name)
+	if !ok {
+		h.writeAndLogError(w, r, ErrNotFound)
+		return
+	}
+	release, err := h.acquire(h.ClientIP(r))
+	if err != nil {
+		h.writeAndLogError(w, r, err)
+		return
+	}
+	defer release()
+	hk, err := newHookFor(h, w, r, name, nil)
+	if err != nil {
+		h.writeAndLogError(w, r, err)
+		return
+	}
+	hk.isSync, hk.streaming = true, false
+	hk.ctx, hk.cancel = context.WithCancel(r.Context())
+	srv := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			h.runWebSocket(ws, hk)
+		},
+	}
+	srv.ServeHTTP(w, r)
+}
+
+func (h *Handler) runWebSocket(ws *websocket.Conn, hk *hook) {
+	hk.w = &headerWriter{make(http.Header)}
+	hk.bindExtra = func(ipt iptpool.ScriptIpt) {
+		ipt.Bind("Ws", luar.Map{
+			// The deadline hook can not interrupt a blocked Go call, so
+			// the connection itself stops at the script deadline.
+			"Send": func(msg string) error {
+				if err := ws.SetWriteDeadline(hk.deadline); err != nil {
+					return err
+				}
+				return websocket.Message.Send(ws, msg)
+			},
+			"Recv": func() (string, error) {
+				if err := ws.SetReadDeadline(hk.deadline); err != nil {
+					return "", err
+				}
+				var msg string
+				err := websocket.Message.Receive(ws, &msg)
+				return msg, err
+			},
+		})
+	}
+	if _, _, err := hk.execute(); err != nil {
+		h.writeAndLogError(nil, hk.r, err)
+		return
+	}
+	h.writeAndLogTags(nil, hk.r, http.StatusSwitchingProtocols, nil, hk.tags())
+}
@@ -0,0 +1,84 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"net/http"
+	"time"
+)
+
+// TimeWindow is a range of the day, on some days of the week, during
+// which a script may run.
+type TimeWindow struct {
+	// Days the window is open on, every day if empty.
+	Days []time.Weekday
+	// From and To are times of day, To exclusive. A window with From
+	// after To spans midnight and belongs to the day it starts on.
+	From, To time.Duration
+	// Location of the window, the handler's timezone if nil.
+	Location *time.Location
+}
+
+func (w TimeWindow) contains(t time.Time, loc *time.Location) bool {
+	if w.Location != nil {
+		loc = w.Location
+	}
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	tod := t.Sub(midnight)
+	day := t.Weekday()
+	if w.From > w.To {
+		if tod >= w.From {
+			return w.on(day)
+		}
+		if tod < w.To {
+			return w.on((day + 6) % 7)
+		}
+		return false
+	}
+	return w.on(day) && tod >= w.From && tod < w.To
+}
+
+func (w TimeWindow) on(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTimeWindows only runs the script name inside one of windows.
+// Outside of them requests get status and body without running it, e.g.
+// 200 "skipped" or 423 "Locked". No windows removes the restriction.
+func (h *Handler) SetTimeWindows(name string, status int, body string, windows ...TimeWindow) {
+	h.updateOptions(name, func(opts *scriptOptions) {
+		opts.windows = windows
+		opts.windowError = &HttpError{status, body}
+	})
+}
+
+// checkWindow returns the configured error if the script name is
+// outside of its time windows.
+func (h *Handler) checkWindow(name string) error {
+	opts := h.lookup(name)
+	if len(opts.windows) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for _, w := range opts.windows {
+		if w.contains(now, h.location) {
+			return nil
+		}
+	}
+	if opts.windowError.status == 0 {
+		return &HttpError{http.StatusOK, opts.windowError.message}
+	}
+	return opts.windowError
+}
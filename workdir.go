@@ -0,0 +1,81 @@
+// Copyright 2013 Xing Xing <mikespook@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a commercial
+// license that can be found in the LICENSE file.
+
+package ghoko
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// SetWorkDir sets the base working directory of the Exec, ReadFile and
+// WriteFile bindings. Every script works in its own subdirectory named
+// after the script, and paths resolving outside of it are refused.
+func (h *Handler) SetWorkDir(dir string) {
+	if dir == "" {
+		h.workDir = ""
+		return
+	}
+	h.workDir = filepath.Clean(dir)
+}
+
+type workDir string
+
+func (h *Handler) scriptWorkDir(name string) (workDir, error) {
+	if h.workDir == "" {
+		return "", ErrNoWorkDir
+	}
+	d, err := workDir(h.workDir).resolve(name)
+	if err != nil {
+		return "", err
+	}
+	return workDir(d), nil
+}
+
+func (d workDir) resolve(p string) (string, error) {
+	root := string(d)
+	p = filepath.Join(root, p)
+	if p != root && !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return "", ErrOutsideWorkDir
+	}
+	return p, nil
+}
+
+func (d workDir) mkdir() error {
+	return os.MkdirAll(string(d), 0755)
+}
+
+func (d workDir) exec(name string, args ...string) (string, error) {
+	if err := d.mkdir(); err != nil {
+		return "", err
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = string(d)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func (d workDir) readFile(p string) (string, error) {
+	f, err := d.resolve(p)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(f)
+	return string(data), err
+}
+
+func (d workDir) writeFile(p, data string) error {
+	f, err := d.resolve(p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f, []byte(data), 0644)
+}